@@ -2,11 +2,13 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"os"
 	"os/exec"
 	"os/signal"
 	"runtime/debug"
+	"strings"
 	"syscall"
 	"time"
 
@@ -21,7 +23,36 @@ func abortIfCancelled(ctx context.Context, where string) error {
 	return nil
 }
 
+// isAgentFlag reports whether arg is one of the agent's own flags.
+func isAgentFlag(arg string) bool {
+	name, _, _ := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+	return strings.HasPrefix(arg, "-") && flag.Lookup(name) != nil
+}
+
 func main() {
+	flag.StringVar(&services.MappingsFile, "mappings", services.MappingsFile,
+		"path to a YAML or JSON mapping document (defaults to $mappings_file)")
+	dryRun := flag.Bool("dry-run", false,
+		"validate the mappings and print the planned transfers without running the command")
+
+	// The first argument is the job command, whatever it looks like. Agent
+	// flags are only parsed when they come first, or when "--" does; a job
+	// command starting with a dash has to follow "--".
+	args := os.Args[1:]
+	if len(args) > 0 && (isAgentFlag(args[0]) || args[0] == "--") {
+		flag.Parse()
+		args = flag.Args()
+	}
+
+	if *dryRun {
+		services.InitValidate()
+		if err := services.ValidateMappings(os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 	services.Init(ctx, cancel)
@@ -35,51 +66,53 @@ func main() {
 
 	go func() {
 		sig := <-sigChan
-		fmt.Fprintf(services.MultiLogWriter, "Received signal: %s — forwarding to child process\n", sig)
+		services.AgentLog.Info("Received signal, forwarding to child process", "signal", sig.String())
 		if cmd != nil && cmd.Process != nil {
 			syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM) // Send to process group
 		}
 		cancel()
 	}()
 
+	stopCheckpointer := func() {}
+
 	defer func() {
+		stopCheckpointer()
 
 		if err := services.PostProcessMappings(); err != nil {
-			fmt.Fprintf(services.MultiLogWriter, "error in post-process-mappings: %v", err)
+			services.AgentLog.Error("Error in post-process-mappings", "err", err)
 		}
 
 		if err := services.VerboseResourceReport(); err != nil {
-			fmt.Fprintf(services.MultiLogWriter, "Error generating resource report: %v\n", err)
+			services.AgentLog.Error("Error generating resource report", "err", err)
 		}
 
-		if err := services.UploadFile("/tmp/job.log", services.LogFileName); err != nil {
-			fmt.Fprintf(services.MultiLogWriter, "error uploading job log: %v", err)
-
+		if err := services.UploadLogFile(context.Background(), "/tmp/job.log", services.LogFileName); err != nil {
+			services.AgentLog.Error("Error uploading job log", "err", err)
 		}
 
 		if r := recover(); r != nil {
-			fmt.Fprintf(services.MultiLogWriter, "Panic: %v\nStack trace: %s\n", r, debug.Stack())
+			services.AgentLog.Error(fmt.Sprintf("Panic: %v\nStack trace: %s", r, debug.Stack()))
 		} else if errOccurred != nil {
 			if err := services.UpdateJobStatus("ERROR"); err != nil {
-				fmt.Fprintf(services.MultiLogWriter, "Error updating status to ERROR: %v \n", err)
+				services.AgentLog.Error("Error updating status to ERROR", "err", err)
 			}
-			fmt.Fprintf(services.MultiLogWriter, "Error: %v \n", errOccurred)
+			services.AgentLog.Error("Error: " + errOccurred.Error())
 		} else {
 
 			if err := services.UpdateJobStatus("DONE"); err != nil {
-				fmt.Fprintf(services.MultiLogWriter, "error updating status to DONE: %v", err)
+				services.AgentLog.Error("Error updating status to DONE", "err", err)
 			}
 		}
 
 		services.RemoteLogSink.FinalFlush()
 	}()
 
-	if len(os.Args) < 2 {
-		errOccurred = fmt.Errorf("usage: go run main.go <command>")
+	if len(args) < 1 {
+		errOccurred = fmt.Errorf("usage: go run main.go [-mappings file] [--] <command>")
 		return
 	}
 
-	command := os.Args[1]
+	command := args[0]
 	// cmd = exec.Command("/bin/sh", "-c", command)
 	cmd = exec.CommandContext(ctx, "/bin/sh", "-c", command)
 	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
@@ -88,7 +121,7 @@ func main() {
 		<-ctx.Done()
 		if cmd != nil && cmd.Process != nil {
 			pgid := -cmd.Process.Pid
-			fmt.Printf("Context cancelled — killing process group %d\n", -pgid)
+			services.AgentLog.Info("Context cancelled, killing process group", "pgid", -pgid)
 			syscall.Kill(pgid, syscall.SIGTERM)
 			time.AfterFunc(10*time.Second, func() {
 				syscall.Kill(pgid, syscall.SIGKILL)
@@ -97,15 +130,15 @@ func main() {
 	}()
 
 	cmd.Env = append(os.Environ(), "PYTHONUNBUFFERED=1")
-	cmd.Stdout = services.MultiLogWriter
-	cmd.Stderr = services.MultiLogWriter
+	cmd.Stdout = services.JobStdout
+	cmd.Stderr = services.JobStderr
 
 	if err := services.UpdateJobStatus("MAPPING_INPUTS"); err != nil {
 		errOccurred = fmt.Errorf("error updating status to MAPPING_INPUTS: %v", err)
 		return
 	}
 
-	if err := services.PreProcessMappings(); err != nil {
+	if err := services.PreProcessMappings(ctx); err != nil {
 		errOccurred = fmt.Errorf("error in pre-process-mappings: %v", err)
 		return
 	}
@@ -125,6 +158,8 @@ func main() {
 		return
 	}
 
+	stopCheckpointer = services.StartOutputCheckpointer(ctx)
+
 	if socketAddress := os.Getenv("interactive_socket"); socketAddress != "" {
 		tunnelErrCh := make(chan error, 1)
 		services.StartTunnelWithRestart(ctx, socketAddress, tunnelErrCh)
@@ -132,7 +167,7 @@ func main() {
 		go func() {
 			select {
 			case err := <-tunnelErrCh:
-				fmt.Fprintf(services.MultiLogWriter, "❌ Tunnel broke: %v — shutting down job\n", err)
+				services.AgentLog.Error("❌ Tunnel broke, shutting down job", "err", err)
 				cancel()
 			case <-ctx.Done():
 			}
@@ -151,7 +186,13 @@ func main() {
 	}
 
 	// Wait for command to complete
-	if err := cmd.Wait(); err != nil {
+	err := cmd.Wait()
+
+	// Output the command ended without a newline.
+	services.JobStdout.Flush()
+	services.JobStderr.Flush()
+
+	if err != nil {
 		if ctx.Err() != nil {
 			errOccurred = fmt.Errorf("Command interrupted due to context cancellation: %v\n", ctx.Err())
 			return
@@ -160,6 +201,8 @@ func main() {
 		return
 	}
 
+	stopCheckpointer()
+
 	if err := services.UpdateJobStatus("MAPPING_OUTPUTS"); err != nil {
 		errOccurred = fmt.Errorf("error updating status to MAPPING_OUTPUTS: %v", err)
 		return
@@ -6,7 +6,10 @@ toolchain go1.24.1
 
 require (
 	github.com/google/uuid v1.6.0
+	github.com/klauspost/compress v1.18.0
 	golang.org/x/net v0.42.0
+	golang.org/x/sync v0.16.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require golang.org/x/text v0.27.0 // indirect
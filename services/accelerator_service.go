@@ -5,16 +5,12 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"os"
-	"sort"
-	"strconv"
 	"strings"
-	"sync"
 )
 
 func getenvWithDefault(key, fallback string) string {
@@ -106,9 +102,13 @@ type MultipartUploadIDCreateResponse struct {
 }
 
 // getPutCreateMultipartUploadID retrieves a multipart upload ID for creating a new upload.
-func getPutCreateMultipartUploadID(filename string) (*MultipartUploadIDCreateResponse, error) {
+// A non-empty contentEncoding is stored as the Content-Encoding of the object.
+func getPutCreateMultipartUploadID(filename, contentEncoding string) (*MultipartUploadIDCreateResponse, error) {
 	encodedFilename := url.PathEscape(filename)
 	endpoint := fmt.Sprintf("/multipart-upload-id?filename=%s", encodedFilename)
+	if contentEncoding != "" {
+		endpoint += "&content_encoding=" + url.QueryEscape(contentEncoding)
+	}
 	req, err := CreateRequest("GET", endpoint, nil)
 
 	if err != nil {
@@ -134,8 +134,15 @@ func getPutCreateMultipartUploadID(filename string) (*MultipartUploadIDCreateRes
 	return &result, nil
 }
 
+// uploadChecksums are the hex digests of a whole uploaded file, sent along
+// with the upload completion so outputs can be verified later.
+type uploadChecksums struct {
+	SHA256 string `json:"sha256"`
+	MD5    string `json:"md5"`
+}
+
 // completeJobMultipartUpload completes a multipart upload for a job.
-func completeJobMultipartUpload(appBucketID int, filename, uploadID string, parts [][]string, isLogFile bool) (*int, error) {
+func completeJobMultipartUpload(appBucketID int, filename, uploadID string, parts [][]string, isLogFile bool, checksums *uploadChecksums, contentEncoding string) (*int, error) {
 	partsJSON, err := json.Marshal(parts)
 	if err != nil {
 		return nil, err
@@ -148,6 +155,10 @@ func completeJobMultipartUpload(appBucketID int, filename, uploadID string, part
 		"upload_id":     uploadID,
 		"parts":         partsBase64,
 		"is_log_file":   isLogFile,
+		"checksums":     checksums,
+	}
+	if contentEncoding != "" {
+		payload["content_encoding"] = contentEncoding
 	}
 
 	body, err := json.Marshal(payload)
@@ -257,183 +268,25 @@ func EnumerateFilesByPrefix(prefix string) ([]string, error) {
 	return result, nil
 }
 
-// readPartData reads part data of a given size from a stream.
-func readPartData(stream io.Reader, size int, partData []byte) ([]byte, error) {
-	size -= len(partData)
-	buf := make([]byte, size)
-	for size > 0 {
-		n, err := stream.Read(buf)
-		if err != nil && err != io.EOF {
-			return nil, err
-		}
-		if n == 0 {
-			break // EOF reached
-		}
-		partData = append(partData, buf[:n]...)
-		size -= n
-	}
-	return partData, nil
+// repoFile is the answer of get-file-download-url: a presigned download URL
+// and the checksums the accelerator recorded for the file when it was
+// uploaded. An answer that is just the URL carries no checksums.
+type repoFile struct {
+	URL    string `json:"url"`
+	SHA256 string `json:"sha256"`
+	MD5    string `json:"md5"`
 }
 
-func addFilestreamAsJobOutput(filename string, fileStream io.Reader, isLogFile bool) (result *int, err error) {
-	partSize := 100 * 1024 * 1024
-	var uploadIDDetailsResponse = &MultipartUploadIDCreateResponse{}
-	var oneByte []byte
-	stop := false
-	partNumber := 0
-	var uploadedSize int
-	var putPresignedURL string
-
-	var parts [][]string
-	var mutex sync.Mutex
-	var wg sync.WaitGroup
-	semaphore := make(chan struct{}, 5) // Limit to 5 concurrent uploads
-	errChan := make(chan error, 1)      // Capture any errors
-
-	// Create a cancellable context
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel() // Ensure cancellation on function exit
-
-	for !stop {
-		partNumber++
-		partData, err := readPartData(fileStream, partSize+1, oneByte)
-		if err != nil {
-			cancel() // Cancel all Goroutines
-			return nil, fmt.Errorf("error reading part data: %v", err)
-		}
-
-		if len(partData) <= partSize {
-			stop = true
-		} else {
-			oneByte = partData[len(partData)-1:]
-			partData = partData[:len(partData)-1]
-		}
-
-		uploadedSize += len(partData)
-
-		if uploadIDDetailsResponse.UploadID == "" {
-			uploadIDDetailsResponse, err = getPutCreateMultipartUploadID(filename)
-			if err != nil {
-				cancel()
-				return nil, fmt.Errorf("error getting upload ID: %v", err)
-			}
-		}
-
-		signedURLResult, err := getMultipartPutCreateSignedURL(uploadIDDetailsResponse.AppBucketID,
-			uploadIDDetailsResponse.UniquifiedFilename,
-			uploadIDDetailsResponse.UploadID,
-			partNumber)
-		if err != nil {
-			cancel()
-			return nil, fmt.Errorf("error getting signed URL: %v", err)
-		}
-		putPresignedURL = *signedURLResult
-
-		wg.Add(1)
-		semaphore <- struct{}{} // Acquire slot
-
-		go func(partNumber int, partData []byte, putPresignedURL string) {
-			defer wg.Done()
-			defer func() { <-semaphore }() // Release slot
-
-			select {
-			case <-ctx.Done():
-				return
-			default:
-			}
-
-			req, err := http.NewRequest("PUT", putPresignedURL, bytes.NewReader(partData))
-			if err != nil {
-				errChan <- fmt.Errorf("error creating part upload request: %v", err)
-				cancel()
-				return
-			}
-			req.Header.Set("Content-Type", "application/octet-stream")
-
-			resp, err := HTTPClientWithRetry.Do(req)
-			if err != nil {
-				errChan <- fmt.Errorf("error uploading part: %v", err)
-				cancel()
-				return
-			}
-			defer resp.Body.Close()
-
-			if resp.StatusCode != http.StatusOK {
-				errChan <- fmt.Errorf("part upload failed with status: %s", resp.Status)
-				cancel()
-				return
-			}
-
-			etag := resp.Header.Get("ETag")
-			if etag == "" {
-				errChan <- errors.New("ETag not found in part upload response")
-				cancel()
-				return
-			}
-			etag = strings.Trim(etag, `"`)
-
-			mutex.Lock()
-			parts = append(parts, []string{fmt.Sprintf("%d", partNumber), etag})
-			mutex.Unlock()
-
-		}(partNumber, partData, putPresignedURL)
-	}
-
-	wg.Wait()
-
-	select {
-	case err = <-errChan:
-		return nil, fmt.Errorf("error uploading part of multipart upload: %w", err)
-	default:
-	}
-
-	// Sort the parts array by partNumber (converted to integer) before calling completeJobMultipartUpload
-	sort.Slice(parts, func(i, j int) bool {
-		partNumberI, _ := strconv.Atoi(parts[i][0])
-		partNumberJ, _ := strconv.Atoi(parts[j][0])
-		return partNumberI < partNumberJ
-	})
-
-	// Complete the upload only if everything is successful
-	result, err = completeJobMultipartUpload(uploadIDDetailsResponse.AppBucketID,
-		uploadIDDetailsResponse.UniquifiedFilename,
-		uploadIDDetailsResponse.UploadID, parts, isLogFile)
-	if err != nil {
-		return nil, fmt.Errorf("error completing multipart upload: %v", err)
-	}
-
-	if err != nil && uploadIDDetailsResponse.UploadID != "" {
-		_, err = abortCreateMultipartUpload(uploadIDDetailsResponse.AppBucketID,
-			uploadIDDetailsResponse.UniquifiedFilename,
-			uploadIDDetailsResponse.UploadID)
-		return nil, fmt.Errorf("error aborting upload: %v", err)
-	}
-
-	return result, nil
-}
-
-func UploadFile(localPath string, remotePath string) error {
-
-	fmt.Fprintf(MultiLogWriter, "Uploading file: %s to remote job output folder at %s \n", localPath, remotePath)
-
-	// Open the files
-	file, err := os.Open(localPath)
-	if err != nil {
-		return fmt.Errorf("error opening file: %v", err)
-	}
-	defer file.Close()
-
-	// Upload the file with the given remote path
-	result, err := addFilestreamAsJobOutput(remotePath, file, false)
-	if err != nil {
-		return fmt.Errorf("error uploading file: %v", err)
+func (f *repoFile) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &f.URL); err == nil {
+		return nil
 	}
 
-	fmt.Fprintf(MultiLogWriter, "Upload successful. Bucket Object ID: %d \n", *result)
-	return nil
+	type plain repoFile
+	return json.Unmarshal(data, (*plain)(f))
 }
 
-func getFileURLFromRepo(filename string) (string, error) {
+func getFileURLFromRepo(filename string) (*repoFile, error) {
 	// Extract the project slug from the filename
 	projectSlug := strings.Split(filename, "/")[0]
 
@@ -445,81 +298,49 @@ func getFileURLFromRepo(filename string) (string, error) {
 	// Create the HTTP request
 	req, err := CreateRequest("GET", endpoint, nil)
 	if err != nil {
-		return "", fmt.Errorf("error creating request: %v", err)
+		return nil, fmt.Errorf("error creating request: %v", err)
 	}
 
 	// Send the request
 	resp, err := HTTPClientWithRetry.Do(req)
 	if err != nil {
-		return "", fmt.Errorf("error sending request: %v", err)
+		return nil, fmt.Errorf("error sending request: %v", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
 		err := HandleHTTPError(resp)
-		return "", fmt.Errorf("GET %s returned not okay status %v", endpoint, err)
+		return nil, fmt.Errorf("GET %s returned not okay status %v", endpoint, err)
 	}
 
 	// Decode the response
-	var result string
+	var result repoFile
 	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return "", fmt.Errorf("error decoding response: %v", err)
-	}
-
-	return result, nil
-}
-
-// downloadFileFromURL downloads a file from the given URL and saves it to the specified path.
-func downloadFileFromURL(url, outputPath string) error {
-	// Create the output file
-	outputFile, err := os.Create(outputPath)
-	if err != nil {
-		return fmt.Errorf("error creating output file: %v", err)
-	}
-	defer outputFile.Close()
-
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return fmt.Errorf("error creating request %v", err)
-
-	}
-
-	// Send a GET request to the download URL
-	resp, err := HTTPClientWithRetry.Do(req)
-	if err != nil {
-		return fmt.Errorf("error downloading file: %v", err)
-	}
-	defer resp.Body.Close()
-
-	// Check if the response status is OK
-	if resp.StatusCode != http.StatusOK {
-		err := HandleHTTPError(resp)
-		return fmt.Errorf("GET %s returned not okay status %v", url, err)
+		return nil, fmt.Errorf("error decoding response: %v", err)
 	}
 
-	// Copy the response body to the output file
-	_, err = io.Copy(outputFile, resp.Body)
-	if err != nil {
-		return fmt.Errorf("error saving file: %v", err)
-	}
-
-	return nil
+	return &result, nil
 }
 
 // downloadFileFromRepo downloads a file from the repository to the specified path.
-func DownloadFileFromRepo(filename, outputPath string) error {
+func DownloadFileFromRepo(ctx context.Context, filename, outputPath string) error {
 	// Get the download URL for the file
-	downloadURL, err := getFileURLFromRepo(filename)
+	file, err := getFileURLFromRepo(filename)
 	if err != nil {
 		return fmt.Errorf("error getting download URL: %v", err)
 	}
 
-	// Download the file from the URL
-	if err := downloadFileFromURL(downloadURL, outputPath); err != nil {
+	// Download the file from the URL, through the node cache when enabled
+	if DownloadCache != nil {
+		err = DownloadCache.Download(ctx, filename, file, outputPath)
+	} else {
+		err = downloadFileFromURL(ctx, file, outputPath)
+	}
+	if err != nil {
 		return fmt.Errorf("error downloading file: %v", err)
 	}
 
-	fmt.Fprintf(MultiLogWriter, "File downloaded successfully to %s\n", outputPath)
+	mappingsLog.Debug("File downloaded successfully", "path", outputPath)
 	return nil
 }
 
@@ -588,7 +409,7 @@ func ReportNodeName() error {
 	}
 	nodeName := os.Getenv("CLUSTER_NODE_NAME")
 	if nodeName == "" {
-		fmt.Fprintf(MultiLogWriter, "CLUSTER_NODE_NAME environment variable not found")
+		AgentLog.Warn("CLUSTER_NODE_NAME environment variable not found")
 		return nil
 	}
 	payload := NodeNameReportDataType{Name: nodeName}
@@ -619,11 +440,21 @@ func SendBatch(lines []byte, logFilename string, cancel context.CancelFunc) erro
 		return fmt.Errorf("error decoding signed URL response: %v", err)
 	}
 
+	contentEncoding := LogCompression
+	if contentEncoding != "" {
+		if lines, err = compressBytes(lines, contentEncoding); err != nil {
+			return fmt.Errorf("error compressing log batch: %v", err)
+		}
+	}
+
 	// PUT log data to signed URL
 	putReq, err := http.NewRequest("PUT", signedURLResponse.UploadURL, bytes.NewReader(lines))
 	if err != nil {
 		return fmt.Errorf("error creating PUT request for chunk: %v", err)
 	}
+	if contentEncoding != "" {
+		putReq.Header.Set("Content-Encoding", contentEncoding)
+	}
 
 	putResp, err := HTTPClient.Do(putReq)
 	if err != nil {
@@ -641,6 +472,9 @@ func SendBatch(lines []byte, logFilename string, cancel context.CancelFunc) erro
 		"filename":      signedURLResponse.Filename,
 		"app_bucket_id": signedURLResponse.AppBucketId,
 	}
+	if contentEncoding != "" {
+		postData["content_encoding"] = contentEncoding
+	}
 	postDataBytes, err := json.Marshal(postData)
 	if err != nil {
 		return fmt.Errorf("error encoding post data: %v", err)
@@ -666,7 +500,7 @@ func SendBatch(lines []byte, logFilename string, cancel context.CancelFunc) erro
 
 	if !signedURLResponse.IsHealthy {
 
-		fmt.Fprintf(MultiLogWriter, "Health check failed: job is not healthy\n")
+		sinkHealthLog.Error("Health check failed: job is not healthy")
 
 		// if err := PostProcessMappings(); err != nil {
 		// 	fmt.Fprintf(MultiLogWriter, "error in post-process-mappings upon bad health of job: %v", err)
@@ -0,0 +1,175 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// The agent's own messages are logged with log/slog. Every record is tagged
+// with the agent component that logged it and goes to the same sinks as the
+// job's output, marked as the agent's so it cannot be taken for a line the
+// job printed. Records below agent_log_level are dropped.
+var (
+	agentLogLevel  = new(slog.LevelVar)
+	agentLogRouter atomic.Pointer[logRouter]
+
+	// AgentLog is the logger of the agent itself, e.g. its command wrapper.
+	AgentLog = newAgentLogger(sourceAgent)
+
+	mappingsLog = newAgentLogger(sourceMappings)
+	tunnelLog   = newAgentLogger(sourceTunnel)
+	healthLog   = newAgentLogger(sourceHealth)
+)
+
+func newAgentLogger(component string) *slog.Logger {
+	return slog.New(&agentLogHandler{component: component})
+}
+
+// newLocalAgentLogger returns a logger whose records only go to the local
+// log, never to the remote sink.
+func newLocalAgentLogger(component string) *slog.Logger {
+	return slog.New(&agentLogHandler{component: component, localOnly: true})
+}
+
+// configureAgentLog reads agent_log_level: debug, info (the default), warn
+// or error. An invalid value keeps info and is returned as an error.
+func configureAgentLog() error {
+	value := os.Getenv("agent_log_level")
+	if value == "" {
+		return nil
+	}
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(value)); err != nil {
+		return fmt.Errorf("invalid agent_log_level %q, using info", value)
+	}
+	agentLogLevel.Set(level)
+
+	return nil
+}
+
+// agentLogHandler turns slog records into log records of the agent stream.
+// Until Init has set up the log router, they are printed to stdout.
+type agentLogHandler struct {
+	component string
+	localOnly bool
+	attrs     []slog.Attr
+	group     string
+}
+
+func (h *agentLogHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= agentLogLevel.Level()
+}
+
+func (h *agentLogHandler) Handle(_ context.Context, r slog.Record) error {
+	attrs := make(map[string]any, len(h.attrs)+r.NumAttrs())
+	for _, attr := range h.attrs {
+		addLogAttr(attrs, "", attr)
+	}
+	r.Attrs(func(attr slog.Attr) bool {
+		addLogAttr(attrs, h.group, attr)
+		return true
+	})
+	if len(attrs) == 0 {
+		attrs = nil
+	}
+
+	router := agentLogRouter.Load()
+
+	// A multi-line message, e.g. a report or a stack trace, becomes one
+	// record per line.
+	for _, line := range strings.Split(r.Message, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		record := logRecord{
+			Time:    r.Time,
+			Stream:  streamAgent,
+			Level:   slogLevel(r.Level),
+			Source:  h.component,
+			Message: line,
+			Attrs:   attrs,
+		}
+
+		switch {
+		case router != nil && h.localOnly:
+			router.emitLocal(record)
+		case router != nil:
+			router.emit(record)
+		default:
+			fmt.Fprintln(os.Stdout, record.text())
+		}
+	}
+
+	return nil
+}
+
+func (h *agentLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	handler := *h
+	handler.attrs = make([]slog.Attr, 0, len(h.attrs)+len(attrs))
+	handler.attrs = append(handler.attrs, h.attrs...)
+	for _, attr := range attrs {
+		if h.group != "" {
+			attr.Key = h.group + "." + attr.Key
+		}
+		handler.attrs = append(handler.attrs, attr)
+	}
+	return &handler
+}
+
+func (h *agentLogHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+
+	handler := *h
+	if h.group != "" {
+		name = h.group + "." + name
+	}
+	handler.group = name
+	return &handler
+}
+
+// addLogAttr flattens attr into attrs, joining group keys with dots. Values
+// that have no plain JSON form, such as errors, are stored as strings.
+func addLogAttr(attrs map[string]any, group string, attr slog.Attr) {
+	attr.Value = attr.Value.Resolve()
+	if attr.Equal(slog.Attr{}) {
+		return
+	}
+
+	key := attr.Key
+	if group != "" {
+		key = group + "." + key
+	}
+
+	value := attr.Value
+	switch value.Kind() {
+	case slog.KindGroup:
+		for _, member := range value.Group() {
+			addLogAttr(attrs, key, member)
+		}
+	case slog.KindString, slog.KindInt64, slog.KindUint64, slog.KindFloat64, slog.KindBool:
+		attrs[key] = value.Any()
+	default:
+		attrs[key] = value.String()
+	}
+}
+
+// slogLevel maps a slog level to the level of a log record.
+func slogLevel(level slog.Level) string {
+	switch {
+	case level >= slog.LevelError:
+		return levelError
+	case level >= slog.LevelWarn:
+		return levelWarn
+	case level >= slog.LevelInfo:
+		return levelInfo
+	}
+	return levelDebug
+}
@@ -0,0 +1,380 @@
+package services
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ArchiveFormat is the format of an archive option: an output mapping packs
+// its source into an archive of that format, an input mapping extracts the
+// archives it downloads.
+type ArchiveFormat string
+
+const (
+	ArchiveTar     ArchiveFormat = "tar"
+	ArchiveTarGzip ArchiveFormat = "tar.gz"
+	ArchiveTarZstd ArchiveFormat = "tar.zst"
+
+	// ArchiveAuto, for input mappings only, picks the format of each
+	// downloaded file from its extension.
+	ArchiveAuto ArchiveFormat = "auto"
+)
+
+func (f ArchiveFormat) extension() string {
+	return "." + string(f)
+}
+
+// encoding is the compression of the archive, empty for a plain tar.
+func (f ArchiveFormat) encoding() string {
+	switch f {
+	case ArchiveTarGzip:
+		return encodingGzip
+	case ArchiveTarZstd:
+		return encodingZstd
+	}
+	return ""
+}
+
+func (f ArchiveFormat) valid() bool {
+	switch f {
+	case ArchiveTar, ArchiveTarGzip, ArchiveTarZstd:
+		return true
+	}
+	return false
+}
+
+// archiveFormatFromName returns the format of an archive by its file name.
+func archiveFormatFromName(name string) (ArchiveFormat, bool) {
+	name = strings.ToLower(name)
+
+	switch {
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return ArchiveTarGzip, true
+	case strings.HasSuffix(name, ".tar.zst"), strings.HasSuffix(name, ".tzst"):
+		return ArchiveTarZstd, true
+	case strings.HasSuffix(name, ".tar"):
+		return ArchiveTar, true
+	}
+
+	return "", false
+}
+
+// writeArchive packs source, a file or a directory tree, into w. Paths
+// rejected by filter are left out.
+func writeArchive(w io.Writer, format ArchiveFormat, source string, filter *pathFilter) error {
+	var compressor io.WriteCloser
+
+	if encoding := format.encoding(); encoding != "" {
+		var err error
+		if compressor, err = newCompressor(w, encoding); err != nil {
+			return err
+		}
+		w = compressor
+	}
+
+	tw := tar.NewWriter(w)
+
+	info, err := os.Stat(source)
+	if err != nil {
+		return err
+	}
+
+	if info.IsDir() {
+		err = filepath.WalkDir(source, func(localPath string, d os.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+
+			relPath, err := filepath.Rel(source, localPath)
+			if err != nil {
+				return err
+			}
+			if relPath == "." {
+				return nil
+			}
+			relPath = filepath.ToSlash(relPath)
+
+			if d.IsDir() {
+				if filter.Excludes(relPath) {
+					return filepath.SkipDir
+				}
+			} else if !filter.Match(relPath) {
+				return nil
+			}
+
+			return addToArchive(tw, localPath, relPath)
+		})
+	} else {
+		err = addToArchive(tw, source, filepath.Base(source))
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+
+	if compressor != nil {
+		return compressor.Close()
+	}
+
+	return nil
+}
+
+func addToArchive(tw *tar.Writer, localPath, name string) error {
+	info, err := os.Lstat(localPath)
+	if err != nil {
+		return err
+	}
+
+	var link string
+	if info.Mode()&os.ModeSymlink != 0 {
+		if link, err = os.Readlink(localPath); err != nil {
+			return err
+		}
+	}
+
+	header, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		// Sockets and the like have no place in an archive.
+		mappingsLog.Warn("Leaving file out of the archive", "path", localPath, "err", err)
+		return nil
+	}
+
+	header.Name = name
+	if info.IsDir() {
+		header.Name += "/"
+	}
+
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+
+	file, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// The header announced info.Size() bytes; a file that grows meanwhile is
+	// cut, one that shrinks fails the archive.
+	if _, err := io.CopyN(tw, file, info.Size()); err != nil {
+		return fmt.Errorf("error archiving %s: %v", localPath, err)
+	}
+
+	return nil
+}
+
+// pushArchive packs the mapping source into an archive and uploads it to the
+// mapping destination. The archive is streamed into the upload as it is
+// written, so it never exists on disk.
+func pushArchive(ctx context.Context, mapping Mapping, filter *pathFilter) error {
+	format := ArchiveFormat(mapping.Options.Archive)
+
+	mappingsLog.Info("Uploading archive to remote job output folder",
+		"path", mapping.Source, "format", string(format), "remote", mapping.Destination)
+
+	reader, writer := io.Pipe()
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		writer.CloseWithError(writeArchive(writer, format, mapping.Source, filter))
+	}()
+
+	started := time.Now()
+	result, err := addFilestreamAsJobOutput(ctx, mapping.Destination, reader, false, "")
+
+	// Stops the archive writer if the upload gave up early.
+	reader.CloseWithError(io.ErrClosedPipe)
+	<-done
+
+	if err != nil {
+		return fmt.Errorf("error uploading archive of %s: %v", mapping.Source, err)
+	}
+
+	mappingsLog.Info("Upload successful", "bucket_object_id", result.BucketObjectID, "sha256", result.Checksums.SHA256)
+
+	jobManifest.addUpload(mapping, mapping.Source, mapping.Destination, result, started)
+
+	return nil
+}
+
+// downloadAndExtract downloads the archive at source and extracts it into the
+// destination directory.
+func downloadAndExtract(ctx context.Context, format ArchiveFormat, source, destination string) error {
+	if format == ArchiveAuto {
+		var ok bool
+		if format, ok = archiveFormatFromName(source); !ok {
+			return fmt.Errorf("error: cannot tell the archive format of %s from its name", source)
+		}
+	}
+
+	if err := os.MkdirAll(destination, os.ModePerm); err != nil {
+		return fmt.Errorf("error creating directory: %v", err)
+	}
+
+	tmpFile, err := os.CreateTemp(destination, ".archive-*")
+	if err != nil {
+		return fmt.Errorf("error creating temporary file: %v", err)
+	}
+	tmpFile.Close()
+	defer os.Remove(tmpFile.Name())
+
+	if err := DownloadFileFromRepo(ctx, source, tmpFile.Name()); err != nil {
+		return err
+	}
+
+	archive, err := os.Open(tmpFile.Name())
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+
+	mappingsLog.Info("Extracting archive", "path", source, "destination", destination)
+
+	if err := extractArchive(archive, format, destination); err != nil {
+		return fmt.Errorf("error extracting %s: %v", source, err)
+	}
+
+	return nil
+}
+
+// extractArchive unpacks a tar archive into destination. Entries that would
+// land outside of destination, by their name or through a symlink extracted
+// before them, are rejected.
+func extractArchive(r io.Reader, format ArchiveFormat, destination string) error {
+	if encoding := format.encoding(); encoding != "" {
+		decompressor, err := newDecompressor(r, encoding)
+		if err != nil {
+			return err
+		}
+		defer decompressor.Close()
+		r = decompressor
+	}
+
+	tr := tar.NewReader(r)
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		name := path.Clean(strings.TrimPrefix(header.Name, "./"))
+		if name == "." {
+			continue
+		}
+		if escapesDir(name) {
+			return fmt.Errorf("archive entry %q is outside of the destination", header.Name)
+		}
+
+		target := filepath.Join(destination, filepath.FromSlash(name))
+
+		parent := path.Dir(name)
+		if header.Typeflag == tar.TypeDir {
+			parent = name
+		}
+		if err := checkEntryPath(destination, parent); err != nil {
+			return fmt.Errorf("archive entry %q: %v", header.Name, err)
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, header.FileInfo().Mode().Perm()|0700); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), os.ModePerm); err != nil {
+				return err
+			}
+			if err := extractFile(tr, target, header.FileInfo().Mode().Perm()); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if path.IsAbs(header.Linkname) || escapesDir(path.Join(path.Dir(name), header.Linkname)) {
+				return fmt.Errorf("archive entry %q links outside of the destination", header.Name)
+			}
+			if err := os.MkdirAll(filepath.Dir(target), os.ModePerm); err != nil {
+				return err
+			}
+			os.Remove(target)
+			if err := os.Symlink(header.Linkname, target); err != nil {
+				return err
+			}
+		default:
+			mappingsLog.Warn("Skipping archive entry of unsupported type", "entry", header.Name)
+		}
+	}
+}
+
+// extractFile writes a regular file entry to target. A file or symlink
+// already at target is replaced, never written through.
+func extractFile(r io.Reader, target string, mode os.FileMode) error {
+	if info, err := os.Lstat(target); err == nil && !info.IsDir() {
+		if err := os.Remove(target); err != nil {
+			return err
+		}
+	}
+
+	file, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY|syscall.O_NOFOLLOW, mode)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(file, r)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// checkEntryPath fails when a part of the slash path name within destination
+// is an existing symlink, so that entries cannot be redirected through links
+// extracted earlier from the same archive.
+func checkEntryPath(destination, name string) error {
+	if name == "." {
+		return nil
+	}
+
+	current := destination
+	for _, part := range strings.Split(name, "/") {
+		current = filepath.Join(current, part)
+
+		info, err := os.Lstat(current)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("path passes through the symlink %s", current)
+		}
+	}
+
+	return nil
+}
+
+// escapesDir reports whether a cleaned relative slash path points outside of
+// the directory it is relative to.
+func escapesDir(name string) bool {
+	return path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../")
+}
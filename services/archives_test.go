@@ -0,0 +1,166 @@
+package services
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type tarEntry struct {
+	name     string
+	typeflag byte
+	linkname string
+	body     string
+}
+
+func buildTar(t *testing.T, entries []tarEntry) *bytes.Buffer {
+	t.Helper()
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, entry := range entries {
+		header := &tar.Header{
+			Name:     entry.name,
+			Typeflag: entry.typeflag,
+			Linkname: entry.linkname,
+			Mode:     0644,
+			Size:     int64(len(entry.body)),
+		}
+		if entry.typeflag == tar.TypeDir {
+			header.Mode = 0755
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(entry.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return &buf
+}
+
+func TestExtractArchiveRejectsEscapes(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []tarEntry
+	}{
+		{"parent dir", []tarEntry{
+			{name: "../evil", typeflag: tar.TypeReg, body: "x"},
+		}},
+		{"parent dir inside the name", []tarEntry{
+			{name: "a/../../evil", typeflag: tar.TypeReg, body: "x"},
+		}},
+		{"absolute symlink", []tarEntry{
+			{name: "link", typeflag: tar.TypeSymlink, linkname: "/etc"},
+		}},
+		{"symlink to parent dir", []tarEntry{
+			{name: "a/link", typeflag: tar.TypeSymlink, linkname: "../../outside"},
+		}},
+		{"file through an extracted symlink", []tarEntry{
+			{name: "link", typeflag: tar.TypeSymlink, linkname: "."},
+			{name: "link/evil", typeflag: tar.TypeReg, body: "x"},
+		}},
+		{"chained symlinks", []tarEntry{
+			{name: "a/", typeflag: tar.TypeDir},
+			{name: "a/b", typeflag: tar.TypeSymlink, linkname: ".."},
+			{name: "a/b/c", typeflag: tar.TypeSymlink, linkname: ".."},
+			{name: "a/b/c/evil", typeflag: tar.TypeReg, body: "x"},
+		}},
+		{"directory over a symlink", []tarEntry{
+			{name: "link", typeflag: tar.TypeSymlink, linkname: "."},
+			{name: "link/", typeflag: tar.TypeDir},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			destination := filepath.Join(root, "dest", "inner")
+			if err := os.MkdirAll(destination, 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			err := extractArchive(buildTar(t, tt.entries), ArchiveTar, destination)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+
+			for _, outside := range []string{
+				filepath.Join(root, "evil"),
+				filepath.Join(root, "dest", "evil"),
+			} {
+				if _, err := os.Lstat(outside); err == nil {
+					t.Fatalf("%s was written outside of the destination", outside)
+				}
+			}
+		})
+	}
+}
+
+func TestExtractArchive(t *testing.T) {
+	destination := t.TempDir()
+
+	archive := buildTar(t, []tarEntry{
+		{name: "./data/", typeflag: tar.TypeDir},
+		{name: "./data/a.csv", typeflag: tar.TypeReg, body: "a"},
+		{name: "data/sub/b.csv", typeflag: tar.TypeReg, body: "b"},
+		{name: "latest", typeflag: tar.TypeSymlink, linkname: "data/a.csv"},
+	})
+
+	if err := extractArchive(archive, ArchiveTar, destination); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range map[string]string{
+		"data/a.csv":     "a",
+		"data/sub/b.csv": "b",
+		"latest":         "a",
+	} {
+		got, err := os.ReadFile(filepath.Join(destination, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestExtractArchiveReplacesExistingSymlink(t *testing.T) {
+	root := t.TempDir()
+	destination := filepath.Join(root, "dest")
+	outside := filepath.Join(root, "outside")
+
+	if err := os.MkdirAll(destination, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(outside, []byte("original"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(destination, "file")); err != nil {
+		t.Fatal(err)
+	}
+
+	archive := buildTar(t, []tarEntry{{name: "file", typeflag: tar.TypeReg, body: "new"}})
+	if err := extractArchive(archive, ArchiveTar, destination); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, _ := os.ReadFile(outside); string(got) != "original" {
+		t.Errorf("the file behind the symlink was overwritten: %q", got)
+	}
+
+	info, err := os.Lstat(filepath.Join(destination, "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.Mode().IsRegular() {
+		t.Errorf("file is %v, want a regular file", info.Mode())
+	}
+}
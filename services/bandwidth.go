@@ -0,0 +1,152 @@
+package services
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	// Throttled reads are cut into pieces of at most throttleChunkSize bytes,
+	// so a transfer never runs far ahead of its limit.
+	throttleChunkSize = 32 * 1024
+
+	// A bucket holds at most minBucketBurst bytes or a tenth of a second
+	// worth of its rate, whichever is more.
+	minBucketBurst = 64 * 1024
+)
+
+// tokenBucket limits a byte rate. Takers reserve tokens up front and wait for
+// the debt to be paid off, so concurrent takers share the rate fairly.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket returns a bucket for bytesPerSecond, or nil when the rate
+// is not limited.
+func newTokenBucket(bytesPerSecond int64) *tokenBucket {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+
+	burst := max(float64(bytesPerSecond)/10, minBucketBurst)
+
+	return &tokenBucket{
+		rate:   float64(bytesPerSecond),
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// wait takes n tokens and blocks until the bucket has paid for them.
+func (b *tokenBucket) wait(ctx context.Context, n int) error {
+	if b == nil || n <= 0 {
+		return nil
+	}
+
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*b.rate, b.burst)
+	b.last = now
+	b.tokens -= float64(n)
+	delay := time.Duration(-b.tokens / b.rate * float64(time.Second))
+	b.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+var (
+	bandwidthOnce     sync.Once
+	downloadBandwidth *tokenBucket
+	uploadBandwidth   *tokenBucket
+	perTransferLimit  int64
+)
+
+// configureBandwidth reads bandwidth_limit, the bytes per second all
+// downloads, and separately all uploads, may use together, and
+// bandwidth_limit_per_transfer, the bytes per second of a single file.
+// Unset or 0 means unlimited.
+func configureBandwidth() {
+	bandwidthOnce.Do(func() {
+		limit := int64(getenvInt("bandwidth_limit", 0))
+		downloadBandwidth = newTokenBucket(limit)
+		uploadBandwidth = newTokenBucket(limit)
+		perTransferLimit = int64(getenvInt("bandwidth_limit_per_transfer", 0))
+	})
+}
+
+// bandwidthLimit throttles a single transfer to the shared limit of its
+// direction and to its own per-transfer limit. A nil limit does not throttle.
+type bandwidthLimit struct {
+	buckets []*tokenBucket
+}
+
+func newBandwidthLimit(direction string) *bandwidthLimit {
+	configureBandwidth()
+
+	shared := uploadBandwidth
+	if direction == transferDownload {
+		shared = downloadBandwidth
+	}
+
+	var buckets []*tokenBucket
+	for _, bucket := range []*tokenBucket{shared, newTokenBucket(perTransferLimit)} {
+		if bucket != nil {
+			buckets = append(buckets, bucket)
+		}
+	}
+
+	if len(buckets) == 0 {
+		return nil
+	}
+
+	return &bandwidthLimit{buckets: buckets}
+}
+
+// reader returns r throttled to the limit. Waiting stops when ctx is done.
+func (l *bandwidthLimit) reader(ctx context.Context, r io.Reader) io.Reader {
+	if l == nil {
+		return r
+	}
+	return &throttledReader{ctx: ctx, r: r, limit: l}
+}
+
+type throttledReader struct {
+	ctx   context.Context
+	r     io.Reader
+	limit *bandwidthLimit
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > throttleChunkSize {
+		p = p[:throttleChunkSize]
+	}
+
+	n, err := t.r.Read(p)
+
+	for _, bucket := range t.limit.buckets {
+		if waitErr := bucket.wait(t.ctx, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+
+	return n, err
+}
@@ -0,0 +1,208 @@
+package services
+
+import (
+	"context"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	defaultCheckpointSettle = 60 * time.Second
+	maxCheckpointScan       = 30 * time.Second
+)
+
+// uploadLedger remembers which local files have been uploaded and in which
+// state, so the final output push does not upload again what a checkpoint
+// already saved.
+type uploadLedger struct {
+	mu    sync.Mutex
+	files map[string]uploadedFile
+}
+
+type uploadedFile struct {
+	destPath string
+	size     int64
+	modTime  time.Time
+}
+
+var uploadedOutputs = &uploadLedger{files: make(map[string]uploadedFile)}
+
+func (l *uploadLedger) unchanged(localPath, destPath string, info os.FileInfo) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	uploaded, ok := l.files[localPath]
+	return ok && uploaded.destPath == destPath &&
+		uploaded.size == info.Size() && uploaded.modTime.Equal(info.ModTime())
+}
+
+// record stores the state the file had before it was uploaded. A file that
+// changed during the upload therefore looks changed on the next pass.
+func (l *uploadLedger) record(localPath, destPath string, info os.FileInfo) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.files[localPath] = uploadedFile{destPath: destPath, size: info.Size(), modTime: info.ModTime()}
+}
+
+// outputCheckpointer uploads new and changed output files while the job runs,
+// so a hard kill of the pod loses at most the work since the last checkpoint.
+// A file is only uploaded once it has not been modified for the settle
+// period. Settled files are uploaded as soon as the whole output source has
+// gone quiet, and otherwise once per interval.
+type outputCheckpointer struct {
+	mappings []Mapping
+	interval time.Duration
+	settle   time.Duration
+	lastRun  map[string]time.Time
+}
+
+// StartOutputCheckpointer starts checkpointing the acc:// output mappings when
+// output_checkpoint_interval is set (e.g. "15m"). output_checkpoint_settle
+// overrides how long a file must stay unmodified before it is uploaded. The
+// returned function cancels the checkpointer, aborting an upload in flight,
+// and waits for it to exit; it must be called before PostProcessMappings.
+func StartOutputCheckpointer(ctx context.Context) func() {
+	intervalFromEnv := os.Getenv("output_checkpoint_interval")
+	if intervalFromEnv == "" {
+		return func() {}
+	}
+
+	interval, err := time.ParseDuration(intervalFromEnv)
+	if err != nil || interval <= 0 {
+		mappingsLog.Warn("Invalid output_checkpoint_interval, checkpoints disabled", "output_checkpoint_interval", intervalFromEnv)
+		return func() {}
+	}
+
+	settle := defaultCheckpointSettle
+	if settleFromEnv := os.Getenv("output_checkpoint_settle"); settleFromEnv != "" {
+		if settle, err = time.ParseDuration(settleFromEnv); err != nil {
+			mappingsLog.Warn("Invalid output_checkpoint_settle, using the default", "output_checkpoint_settle", settleFromEnv, "default", defaultCheckpointSettle)
+			settle = defaultCheckpointSettle
+		}
+	}
+
+	spec, err := LoadMappingSpec()
+	if err != nil {
+		mappingsLog.Warn("Checkpoints disabled", "err", err)
+		return func() {}
+	}
+
+	c := &outputCheckpointer{
+		interval: interval,
+		settle:   settle,
+		lastRun:  make(map[string]time.Time),
+	}
+
+	for _, mapping := range spec.Outputs {
+		// Archives are only meaningful once complete.
+		if mapping.Kind == MappingKindAccelerator && mapping.Options.Archive == "" {
+			c.mappings = append(c.mappings, mapping)
+		}
+	}
+
+	if len(c.mappings) == 0 {
+		return func() {}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		c.run(ctx)
+	}()
+
+	mappingsLog.Info("Output checkpoints enabled", "interval", interval)
+
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+func (c *outputCheckpointer) run(ctx context.Context) {
+	tick := time.NewTicker(min(c.interval, maxCheckpointScan))
+	defer tick.Stop()
+
+	started := time.Now()
+	for _, mapping := range c.mappings {
+		c.lastRun[mapping.Source] = started
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+			for _, mapping := range c.mappings {
+				if err := c.checkpoint(ctx, mapping); err != nil {
+					mappingsLog.Error("Error in output checkpoint", "mapping", mapping.String(), "err", err)
+				}
+			}
+		}
+	}
+}
+
+func (c *outputCheckpointer) checkpoint(ctx context.Context, mapping Mapping) error {
+	if _, err := os.Stat(mapping.Source); os.IsNotExist(err) {
+		return nil
+	}
+
+	filter, err := outputFilter(mapping)
+	if err != nil {
+		return err
+	}
+
+	type pendingFile struct {
+		localPath string
+		destPath  string
+		info      os.FileInfo
+	}
+
+	now := time.Now()
+	var pending []pendingFile
+	var lastModified time.Time
+
+	err = walkOutputSource(mapping.Source, mapping.Destination, filter, func(localPath, destPath string, info os.FileInfo) error {
+		if info.ModTime().After(lastModified) {
+			lastModified = info.ModTime()
+		}
+		if now.Sub(info.ModTime()) >= c.settle && !uploadedOutputs.unchanged(localPath, destPath, info) {
+			pending = append(pending, pendingFile{localPath, destPath, info})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	quiet := now.Sub(lastModified) >= c.settle
+	due := now.Sub(c.lastRun[mapping.Source]) >= c.interval
+
+	if len(pending) == 0 || !(quiet || due) {
+		return nil
+	}
+
+	mappingsLog.Info("Checkpointing output files", "mapping", mapping.String(), "files", len(pending))
+
+	pool := newTransferPool(ctx, getenvInt("upload_concurrency", defaultUploadConcurrency))
+
+	for _, file := range pending {
+		pool.Go(func(ctx context.Context) error {
+			return pushOutputFile(ctx, mapping, file.localPath, file.destPath, file.info)
+		})
+	}
+
+	if err := pool.Wait(); err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return err
+	}
+
+	c.lastRun[mapping.Source] = now
+
+	return nil
+}
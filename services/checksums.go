@@ -0,0 +1,73 @@
+package services
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net/http"
+	"regexp"
+)
+
+// checksums computes the SHA-256 and MD5 digests of everything written to it.
+type checksums struct {
+	sha256 hash.Hash
+	md5    hash.Hash
+}
+
+func newChecksums() *checksums {
+	return &checksums{sha256: sha256.New(), md5: md5.New()}
+}
+
+func (c *checksums) Write(p []byte) (int, error) {
+	c.sha256.Write(p)
+	c.md5.Write(p)
+	return len(p), nil
+}
+
+func (c *checksums) Reset() {
+	c.sha256.Reset()
+	c.md5.Reset()
+}
+
+func (c *checksums) SHA256() string {
+	return hex.EncodeToString(c.sha256.Sum(nil))
+}
+
+func (c *checksums) MD5() string {
+	return hex.EncodeToString(c.md5.Sum(nil))
+}
+
+// md5ETag matches ETags of objects uploaded in a single part. Multipart
+// ETags carry a "-<parts>" suffix and are never an MD5.
+var md5ETag = regexp.MustCompile(`^[0-9a-fA-F]{32}$`)
+
+// etagIsMD5 reports whether etag is the MD5 of the object content. That only
+// holds for single part objects stored unencrypted or with SSE-S3; with
+// SSE-KMS or SSE-C the ETag is an opaque 32 hex digit value.
+func etagIsMD5(header http.Header, etag string) bool {
+	if !md5ETag.MatchString(etag) || header.Get("X-Amz-Server-Side-Encryption-Customer-Algorithm") != "" {
+		return false
+	}
+
+	switch header.Get("X-Amz-Server-Side-Encryption") {
+	case "", "AES256":
+		return true
+	}
+	return false
+}
+
+// verify compares the computed digests with the expected ones. Digests that
+// are not known are not checked.
+func (c *checksums) verify(info *remoteObjectInfo) error {
+	if info.SHA256 != "" && info.SHA256 != c.SHA256() {
+		return fmt.Errorf("checksum mismatch: expected SHA-256 %s, got %s", info.SHA256, c.SHA256())
+	}
+
+	if info.MD5 != "" && info.MD5 != c.MD5() {
+		return fmt.Errorf("checksum mismatch: expected MD5 %s, got %s", info.MD5, c.MD5())
+	}
+
+	return nil
+}
@@ -0,0 +1,123 @@
+package services
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Content encodings that outputs and logs can be compressed with. Objects
+// stored with one of them are decompressed again when downloaded.
+const (
+	encodingGzip = "gzip"
+	encodingZstd = "zstd"
+)
+
+func validContentEncoding(encoding string) bool {
+	return encoding == encodingGzip || encoding == encodingZstd
+}
+
+// newCompressor returns a writer that compresses into w. Closing it flushes
+// the compressed stream but does not close w.
+func newCompressor(w io.Writer, encoding string) (io.WriteCloser, error) {
+	switch encoding {
+	case encodingGzip:
+		return gzip.NewWriter(w), nil
+	case encodingZstd:
+		return zstd.NewWriter(w)
+	}
+	return nil, fmt.Errorf("unsupported content encoding %q", encoding)
+}
+
+// newDecompressor returns a reader of the decompressed content of r.
+func newDecompressor(r io.Reader, encoding string) (io.ReadCloser, error) {
+	switch encoding {
+	case encodingGzip:
+		return gzip.NewReader(r)
+	case encodingZstd:
+		decoder, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	}
+	return nil, fmt.Errorf("unsupported content encoding %q", encoding)
+}
+
+// compressingReader compresses r on the fly. Closing the returned reader
+// stops the compression if the consumer gives up early.
+func compressingReader(r io.Reader, encoding string) io.ReadCloser {
+	reader, writer := io.Pipe()
+
+	go func() {
+		compressor, err := newCompressor(writer, encoding)
+		if err == nil {
+			_, err = io.Copy(compressor, r)
+			if closeErr := compressor.Close(); err == nil {
+				err = closeErr
+			}
+		}
+		writer.CloseWithError(err)
+	}()
+
+	return reader
+}
+
+func compressBytes(data []byte, encoding string) ([]byte, error) {
+	var buf bytes.Buffer
+
+	compressor, err := newCompressor(&buf, encoding)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := compressor.Write(data); err != nil {
+		return nil, err
+	}
+	if err := compressor.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// decompressFile replaces the compressed file at path with its content.
+func decompressFile(path, encoding string) error {
+	compressed, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer compressed.Close()
+
+	content, err := newDecompressor(compressed, encoding)
+	if err != nil {
+		return fmt.Errorf("error decompressing %s: %v", path, err)
+	}
+	defer content.Close()
+
+	tmpFile, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".decompress-*")
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(tmpFile, content)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmpFile.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmpFile.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		return fmt.Errorf("error decompressing %s: %v", path, err)
+	}
+
+	return nil
+}
@@ -5,9 +5,12 @@ import (
 	"crypto/tls"
 	"fmt"
 	"io"
+	"log/slog"
 	"net"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strconv"
 	"time"
 
 	"golang.org/x/net/http2"
@@ -17,9 +20,22 @@ var (
 	HTTPClientWithRetry *http.Client
 	HTTPClient          *http.Client
 	HTTP2Client         *http.Client
+	HTTPTransferClient  *http.Client
 	RemoteLogSink       *RemoteLogger
-	MultiLogWriter      io.Writer
 	LogFileName         string
+
+	// JobStdout and JobStderr take the output of the job command. They go
+	// to the local and remote logs, line by line and tagged with their
+	// stream.
+	JobStdout *lineWriter
+	JobStderr *lineWriter
+
+	// tunnelOutput takes the output of the ssh client of reverse tunnels.
+	tunnelOutput io.Writer
+
+	// LogCompression is the content encoding, gzip or zstd, log batches and
+	// the full job log are uploaded with. Empty uploads them as is.
+	LogCompression = os.Getenv("log_compression")
 )
 
 type RetryTransport struct {
@@ -65,7 +81,17 @@ func isRetryable(err error) bool {
 	return false
 }
 
-func Init(ctx context.Context, cancel context.CancelFunc) {
+// getenvInt returns the integer value of key, or fallback when it is unset
+// or not a number.
+func getenvInt(key string, fallback int) int {
+	value, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+func initHTTPClients() {
 	// Base transport for regular HTTP/1.1
 	transport := &http.Transport{
 		TLSClientConfig:     &tls.Config{InsecureSkipVerify: true},
@@ -95,6 +121,15 @@ func Init(ctx context.Context, cancel context.CancelFunc) {
 		Transport: transport,
 	}
 
+	// Large transfers legitimately outlast any fixed client timeout, so only
+	// the wait for response headers is bounded.
+	transferTransport := transport.Clone()
+	transferTransport.ResponseHeaderTimeout = 60 * time.Second
+
+	HTTPTransferClient = &http.Client{
+		Transport: transferTransport,
+	}
+
 	HTTP2Client = &http.Client{
 		Timeout: 90 * time.Second,
 		Transport: &RetryTransport{
@@ -103,6 +138,10 @@ func Init(ctx context.Context, cancel context.CancelFunc) {
 			Backoff:    1 * time.Second,
 		},
 	}
+}
+
+func Init(ctx context.Context, cancel context.CancelFunc) {
+	initHTTPClients()
 
 	podID := os.Getenv("POD_ID")
 	if podID == "" {
@@ -116,6 +155,64 @@ func Init(ctx context.Context, cancel context.CancelFunc) {
 		panic("failed to open log file: " + err.Error())
 	}
 
-	RemoteLogSink = NewRemoteLogger(ctx, cancel)
-	MultiLogWriter = io.MultiWriter(os.Stdout, RemoteLogSink, logFile)
+	// The agent volume keeps spooled logs across container restarts; the
+	// spool falls back to local disk when it is not mounted.
+	spoolDir := getenvWithDefault("LOG_SPOOL_DIR", defaultLogSpoolDir)
+	spool, spoolErr := newLogSpool(spoolDir)
+	if spoolErr != nil {
+		spool, err = newLogSpool(filepath.Join(os.TempDir(), "wkube-log-spool"))
+		if err != nil {
+			panic("failed to create log spool: " + err.Error())
+		}
+	}
+
+	logSinkConfig, configErr := logSinkConfigFromEnv()
+	logLevelErr := configureAgentLog()
+
+	RemoteLogSink = NewRemoteLogger(ctx, cancel, spool, logSinkConfig)
+
+	router := newLogRouter(io.MultiWriter(os.Stdout, logFile), RemoteLogSink)
+	agentLogRouter.Store(router)
+	tunnelOutput = router.agentWriter(sourceTunnel, slog.LevelInfo)
+	JobStdout = router.jobWriter(streamStdout)
+	JobStderr = router.jobWriter(streamStderr)
+
+	if configErr != nil {
+		AgentLog.Warn(configErr.Error())
+	}
+
+	if logLevelErr != nil {
+		AgentLog.Warn(logLevelErr.Error())
+	}
+
+	if spoolErr != nil {
+		AgentLog.Warn("Log spool unavailable", "dir", spoolDir, "fallback", spool.dir, "err", spoolErr)
+	}
+
+	if LogCompression != "" && !validContentEncoding(LogCompression) {
+		AgentLog.Warn("Unsupported log_compression, logs are uploaded uncompressed", "log_compression", LogCompression)
+		LogCompression = ""
+	}
+
+	DownloadCache, err = newDownloadCache()
+	if err != nil {
+		AgentLog.Info("Download cache disabled", "err", err)
+	}
+
+	pendingUploads, err = newUploadJournal()
+	if err != nil {
+		AgentLog.Info("Upload journal disabled", "err", err)
+	}
+	pendingUploads.sweep()
+}
+
+// InitValidate prepares the package for a dry run: the HTTP clients are set
+// up, but no log file or remote log sink is created and all output goes to
+// stdout.
+func InitValidate() {
+	initHTTPClients()
+	if err := configureAgentLog(); err != nil {
+		AgentLog.Warn(err.Error())
+	}
+	tunnelOutput = os.Stdout
 }
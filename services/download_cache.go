@@ -0,0 +1,348 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultDownloadCacheMaxBytes = 20 * 1024 * 1024 * 1024
+	downloadCacheStaleTempAge    = 24 * time.Hour
+)
+
+// downloadCache is a node-local store of downloaded accelerator files, shared
+// by all jobs that mount the same directory. Entries are keyed by remote path,
+// ETag and size, so a changed object is never served from the cache. Access to
+// an entry is serialized across pods with flock on a lock file next to it, and
+// the least recently used entries are evicted once the cache outgrows its
+// size limit.
+//
+// Layout:
+//
+//	<dir>/objects/<2 hex>/<key>       cached file, read-only
+//	<dir>/objects/<2 hex>/<key>.lock  per-entry lock
+//	<dir>/tmp/                        downloads in progress
+//	<dir>/.evict.lock                 held while evicting
+type downloadCache struct {
+	dir      string
+	maxBytes int64
+	hardlink bool
+}
+
+// DownloadCache is nil unless DOWNLOAD_CACHE_DIR is set.
+var DownloadCache *downloadCache
+
+// newDownloadCache configures the cache from the environment:
+// DOWNLOAD_CACHE_DIR enables it, DOWNLOAD_CACHE_MAX_BYTES bounds its size
+// (0 for unbounded) and DOWNLOAD_CACHE_MODE=hardlink links cached files into
+// place instead of copying them. Hard links share the read-only cache inode,
+// so they only suit jobs that never modify their inputs.
+func newDownloadCache() (*downloadCache, error) {
+	dir := os.Getenv("DOWNLOAD_CACHE_DIR")
+	if dir == "" {
+		return nil, nil
+	}
+
+	maxBytes := int64(defaultDownloadCacheMaxBytes)
+	if value := os.Getenv("DOWNLOAD_CACHE_MAX_BYTES"); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid DOWNLOAD_CACHE_MAX_BYTES %q: %v", value, err)
+		}
+		maxBytes = parsed
+	}
+
+	for _, sub := range []string{"objects", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0775); err != nil {
+			return nil, fmt.Errorf("error creating download cache directory: %v", err)
+		}
+	}
+
+	return &downloadCache{
+		dir:      dir,
+		maxBytes: maxBytes,
+		hardlink: os.Getenv("DOWNLOAD_CACHE_MODE") == "hardlink",
+	}, nil
+}
+
+// lockFile takes a flock on path, creating it if needed, and returns the
+// function that releases it. Eviction deletes lock files while holding them,
+// so a lock taken on a file that has since been unlinked is retried on the
+// file now at path.
+func lockFile(path string, how int) (func(), error) {
+	for {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0664)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := syscall.Flock(int(f.Fd()), how); err != nil {
+			f.Close()
+			return nil, err
+		}
+
+		held, heldErr := f.Stat()
+		current, currentErr := os.Stat(path)
+		if heldErr == nil && currentErr == nil && os.SameFile(held, current) {
+			return func() {
+				syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+				f.Close()
+			}, nil
+		}
+
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+		if heldErr != nil {
+			return nil, heldErr
+		}
+	}
+}
+
+func (c *downloadCache) entryPath(filename string, info *remoteObjectInfo) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%s\x00%d", filename, info.ETag, info.Size)))
+	key := hex.EncodeToString(sum[:])
+	return filepath.Join(c.dir, "objects", key[:2], key)
+}
+
+// Download places the accelerator file behind file's URL at outputPath, serving it
+// from the cache when possible and adding it to the cache otherwise. The
+// cache holds objects as stored; compressed ones are decompressed once in
+// place.
+func (c *downloadCache) Download(ctx context.Context, filename string, file *repoFile, outputPath string) error {
+	info, err := statRemoteObject(ctx, file)
+	if err != nil {
+		return err
+	}
+
+	if err := c.download(ctx, filename, file.URL, info, outputPath); err != nil {
+		return err
+	}
+
+	return decodeDownload(info, outputPath)
+}
+
+func (c *downloadCache) download(ctx context.Context, filename, url string, info *remoteObjectInfo, outputPath string) error {
+	// Without an ETag a changed object cannot be told apart from a cached one.
+	if info.ETag == "" {
+		return downloadObject(ctx, url, info, outputPath, filename)
+	}
+
+	entry := c.entryPath(filename, info)
+	unlock, err := c.lockEntry(entry)
+	if err != nil {
+		// The cache only saves transfers. A directory or lock file this pod
+		// may not use, e.g. one created by a pod running as another user,
+		// must not fail the mapping.
+		mappingsLog.Warn("Download cache unavailable, downloading directly", "file", filename, "err", err)
+		return downloadObject(ctx, url, info, outputPath, filename)
+	}
+
+	if stat, err := os.Stat(entry); err == nil && stat.Size() == info.Size {
+		now := time.Now()
+		_ = os.Chtimes(entry, now, now)
+		err = c.materialize(entry, outputPath)
+		unlock()
+		if err == nil {
+			mappingsLog.Debug("Served from the node download cache", "file", filename)
+		}
+		return err
+	}
+
+	err = c.fill(ctx, filename, url, entry, info)
+	if err != nil && ctx.Err() == nil && isFileSystemError(err) {
+		// E.g. a full cache volume, or a tmp directory this pod may not
+		// write to. Failed transfers are not retried here; they already
+		// were.
+		unlock()
+		mappingsLog.Warn("Download cache unusable, downloading directly", "file", filename, "err", err)
+		return downloadObject(ctx, url, info, outputPath, filename)
+	}
+	if err == nil {
+		err = c.materialize(entry, outputPath)
+	}
+	unlock()
+
+	if err != nil {
+		return err
+	}
+
+	c.evict()
+
+	return nil
+}
+
+func (c *downloadCache) lockEntry(entry string) (func(), error) {
+	if err := os.MkdirAll(filepath.Dir(entry), 0775); err != nil {
+		return nil, fmt.Errorf("error creating download cache directory: %v", err)
+	}
+
+	unlock, err := lockFile(entry+".lock", syscall.LOCK_EX)
+	if err != nil {
+		return nil, fmt.Errorf("error locking download cache entry: %v", err)
+	}
+
+	return unlock, nil
+}
+
+// fill downloads url into the cache entry.
+func (c *downloadCache) fill(ctx context.Context, filename, url, entry string, info *remoteObjectInfo) error {
+	tmpPath := filepath.Join(c.dir, "tmp", filepath.Base(entry))
+	if err := os.MkdirAll(filepath.Dir(tmpPath), 0775); err != nil {
+		return err
+	}
+
+	if err := downloadObject(ctx, url, info, tmpPath, filename); err != nil {
+		return err
+	}
+
+	if err := os.Chmod(tmpPath, 0444); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return os.Rename(tmpPath, entry)
+}
+
+// materialize places a copy or hard link of the cache entry at outputPath.
+// Like a download, it goes to a temporary file renamed into place, so a
+// failure never leaves a truncated input behind.
+func (c *downloadCache) materialize(entry, outputPath string) error {
+	tmpFile, err := os.CreateTemp(filepath.Dir(outputPath), "."+filepath.Base(outputPath)+".download-*")
+	if err != nil {
+		return fmt.Errorf("error creating output file: %v", err)
+	}
+	tmpPath := tmpFile.Name()
+	tmpFile.Close()
+
+	linked := false
+	if c.hardlink {
+		// Different filesystem, fall back to a copy.
+		linked = os.Remove(tmpPath) == nil && os.Link(entry, tmpPath) == nil
+	}
+
+	if !linked {
+		err = copyFile(entry, tmpPath, 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, outputPath)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("error copying file from the download cache: %v", err)
+	}
+
+	return nil
+}
+
+// isFileSystemError reports whether err comes from a local file operation,
+// as opposed to the transfer itself or the verification of its content.
+func isFileSystemError(err error) bool {
+	var pathErr *fs.PathError
+	var linkErr *os.LinkError
+	return errors.As(err, &pathErr) || errors.As(err, &linkErr)
+}
+
+// evict removes the least recently used entries, together with their lock
+// files, until the cache fits its size limit. Entries locked by a running
+// download are left alone, and so is the whole cache when another process is
+// already evicting.
+func (c *downloadCache) evict() {
+	if c.maxBytes <= 0 {
+		return
+	}
+
+	unlock, err := lockFile(filepath.Join(c.dir, ".evict.lock"), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		return
+	}
+	defer unlock()
+
+	type cacheEntry struct {
+		path    string
+		size    int64
+		lastUse time.Time
+	}
+
+	var entries []cacheEntry
+	var locks []string
+	var total int64
+
+	_ = filepath.WalkDir(filepath.Join(c.dir, "objects"), func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if strings.HasSuffix(path, ".lock") {
+			locks = append(locks, path)
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		entries = append(entries, cacheEntry{path: path, size: info.Size(), lastUse: info.ModTime()})
+		total += info.Size()
+		return nil
+	})
+
+	// Lock files left by failed downloads.
+	for _, lock := range locks {
+		if _, err := os.Stat(strings.TrimSuffix(lock, ".lock")); os.IsNotExist(err) {
+			c.removeEntry(strings.TrimSuffix(lock, ".lock"))
+		}
+	}
+
+	// Downloads abandoned by killed pods.
+	if tmpEntries, err := os.ReadDir(filepath.Join(c.dir, "tmp")); err == nil {
+		for _, tmpEntry := range tmpEntries {
+			if info, err := tmpEntry.Info(); err == nil && time.Since(info.ModTime()) > downloadCacheStaleTempAge {
+				_ = os.Remove(filepath.Join(c.dir, "tmp", tmpEntry.Name()))
+			}
+		}
+	}
+
+	if total <= c.maxBytes {
+		return
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].lastUse.Before(entries[j].lastUse)
+	})
+
+	for _, entry := range entries {
+		if total <= c.maxBytes {
+			break
+		}
+
+		if c.removeEntry(entry.path) {
+			total -= entry.size
+		}
+	}
+}
+
+// removeEntry deletes a cache entry and its lock file unless a download
+// holds the lock. It reports whether the entry is gone.
+func (c *downloadCache) removeEntry(entry string) bool {
+	unlock, err := lockFile(entry+".lock", syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		return false
+	}
+	defer unlock()
+
+	if err := os.Remove(entry); err != nil && !os.IsNotExist(err) {
+		return false
+	}
+	_ = os.Remove(entry + ".lock")
+
+	return true
+}
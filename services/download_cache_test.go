@@ -0,0 +1,71 @@
+package services
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// serveObject serves body to the transfer client for the duration of the test
+// and counts the requests it answers.
+func serveObject(t *testing.T, body string) (url string, requests *int) {
+	t.Helper()
+
+	requests = new(int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*requests++
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+
+	client := HTTPTransferClient
+	HTTPTransferClient = server.Client()
+	t.Cleanup(func() { HTTPTransferClient = client })
+
+	return server.URL, requests
+}
+
+func TestDownloadCacheUnusableFallsBack(t *testing.T) {
+	url, _ := serveObject(t, "data")
+
+	cache := &downloadCache{dir: t.TempDir()}
+	// A tmp that is not a directory stands in for a full or foreign volume.
+	if err := os.WriteFile(filepath.Join(cache.dir, "tmp"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	outputPath := filepath.Join(t.TempDir(), "input.csv")
+	info := &remoteObjectInfo{Size: 4, ETag: "etag"}
+	if err := cache.download(context.Background(), "input.csv", url, info, outputPath); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, err := os.ReadFile(outputPath); err != nil || string(got) != "data" {
+		t.Errorf("got %q, %v, want the downloaded file", got, err)
+	}
+}
+
+func TestDownloadCacheServesEntries(t *testing.T) {
+	url, requests := serveObject(t, "data")
+
+	cache := &downloadCache{dir: t.TempDir()}
+	info := &remoteObjectInfo{Size: 4, ETag: "etag"}
+
+	for _, hardlink := range []bool{false, true} {
+		cache.hardlink = hardlink
+		outputPath := filepath.Join(t.TempDir(), "input.csv")
+		if err := cache.download(context.Background(), "input.csv", url, info, outputPath); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := os.ReadFile(outputPath); err != nil || string(got) != "data" {
+			t.Errorf("hardlink=%v: got %q, %v, want the cached file", hardlink, got, err)
+		}
+	}
+
+	if *requests != 1 {
+		t.Errorf("%d requests, want the second download served from the cache", *requests)
+	}
+}
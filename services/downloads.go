@@ -0,0 +1,302 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Objects of at least parallelDownloadThreshold bytes are fetched as
+	// downloadChunkSize ranges, downloadChunkConcurrency at a time.
+	parallelDownloadThreshold = 256 * 1024 * 1024
+	downloadChunkSize         = 64 * 1024 * 1024
+	downloadChunkConcurrency  = 4
+
+	maxDownloadAttempts = 5
+	downloadRetryDelay  = 1 * time.Second
+)
+
+type remoteObjectInfo struct {
+	Size          int64
+	ETag          string
+	AcceptsRanges bool
+
+	// Lower-case hex digests of the content, empty when unknown.
+	SHA256 string
+	MD5    string
+
+	// ContentEncoding is the compression the object was stored with, empty
+	// when it is stored as is. Size and digests are of the stored bytes.
+	ContentEncoding string
+}
+
+// statRemoteObject reads the size and ETag of the object behind the download
+// URL of file. Presigned URLs are only valid for GET, so a one byte range is
+// requested instead of a HEAD. The expected digests are the ones the
+// accelerator returned with the URL.
+func statRemoteObject(ctx context.Context, file *repoFile) (*remoteObjectInfo, error) {
+	url := file.URL
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating request %v", err)
+	}
+	req.Header.Set("Range", "bytes=0-0")
+	req.Header.Set("Accept-Encoding", "identity")
+
+	resp, err := HTTPClientWithRetry.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error requesting object metadata: %v", err)
+	}
+	defer resp.Body.Close()
+
+	info := &remoteObjectInfo{
+		ETag:   strings.Trim(resp.Header.Get("ETag"), `"`),
+		SHA256: strings.ToLower(file.SHA256),
+		MD5:    strings.ToLower(file.MD5),
+	}
+
+	if encoding := strings.ToLower(resp.Header.Get("Content-Encoding")); validContentEncoding(encoding) {
+		info.ContentEncoding = encoding
+	}
+
+	if info.MD5 == "" && etagIsMD5(resp.Header, info.ETag) {
+		info.MD5 = strings.ToLower(info.ETag)
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		info.Size = resp.ContentLength
+	case http.StatusPartialContent, http.StatusRequestedRangeNotSatisfiable:
+		// Content-Range is "bytes 0-0/<size>", or "bytes */0" for empty objects.
+		contentRange := resp.Header.Get("Content-Range")
+		slash := strings.LastIndex(contentRange, "/")
+		if slash < 0 {
+			return nil, fmt.Errorf("invalid Content-Range header %q", contentRange)
+		}
+		info.Size, err = strconv.ParseInt(contentRange[slash+1:], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Content-Range header %q: %v", contentRange, err)
+		}
+		info.AcceptsRanges = true
+	default:
+		err := HandleHTTPError(resp)
+		return nil, fmt.Errorf("GET %s returned not okay status %v", url, err)
+	}
+
+	return info, nil
+}
+
+// downloadFileFromURL downloads a file from the given URL and saves it to the
+// specified path. The data goes to a temporary file next to outputPath that is
+// renamed into place once complete, so a failed download never leaves a
+// truncated file behind. Interrupted transfers resume where they stopped when
+// the server supports range requests, and large objects are fetched as
+// parallel ranges. The content is verified against the checksums the object
+// accelerator reports, and decompressed when the object is stored compressed.
+func downloadFileFromURL(ctx context.Context, file *repoFile, outputPath string) error {
+	info, err := statRemoteObject(ctx, file)
+	if err != nil {
+		return err
+	}
+
+	if err := downloadObject(ctx, file.URL, info, outputPath, outputPath); err != nil {
+		return err
+	}
+
+	return decodeDownload(info, outputPath)
+}
+
+// decodeDownload decompresses a downloaded file in place when the object was
+// stored with a content encoding.
+func decodeDownload(info *remoteObjectInfo, outputPath string) error {
+	if info.ContentEncoding == "" {
+		return nil
+	}
+	return decompressFile(outputPath, info.ContentEncoding)
+}
+
+// downloadObject is downloadFileFromURL for an object that has already been
+// looked up with statRemoteObject. name labels the progress it logs.
+func downloadObject(ctx context.Context, url string, info *remoteObjectInfo, outputPath, name string) error {
+	progress := startProgress(transferDownload, name, info.Size)
+	defer progress.finish()
+
+	limit := newBandwidthLimit(transferDownload)
+
+	tmpFile, err := os.CreateTemp(filepath.Dir(outputPath), "."+filepath.Base(outputPath)+".download-*")
+	if err != nil {
+		return fmt.Errorf("error creating output file: %w", err)
+	}
+	tmpPath := tmpFile.Name()
+
+	err = downloadToFile(ctx, url, info, tmpFile, progress, limit)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmpPath, 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, outputPath)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("error saving file: %w", err)
+	}
+
+	return nil
+}
+
+func downloadToFile(ctx context.Context, url string, info *remoteObjectInfo, file *os.File, progress *transferProgress, limit *bandwidthLimit) error {
+	var sums *checksums
+	if info.SHA256 != "" || info.MD5 != "" {
+		sums = newChecksums()
+	}
+
+	if info.Size == 0 {
+		return verifyDownload(sums, info)
+	}
+
+	if !info.AcceptsRanges || info.Size < parallelDownloadThreshold {
+		if err := downloadRange(ctx, url, info, file, 0, info.Size-1, sums, progress, limit); err != nil {
+			return err
+		}
+		return verifyDownload(sums, info)
+	}
+
+	if err := file.Truncate(info.Size); err != nil {
+		return err
+	}
+
+	pool := newTransferPool(ctx, downloadChunkConcurrency)
+
+	for start := int64(0); start < info.Size; start += downloadChunkSize {
+		end := min(start+downloadChunkSize, info.Size) - 1
+		pool.Go(func(ctx context.Context) error {
+			return downloadRange(ctx, url, info, file, start, end, nil, progress, limit)
+		})
+	}
+
+	if err := pool.Wait(); err != nil {
+		return err
+	}
+
+	// Chunks arrive out of order, so the file is hashed once complete.
+	if sums != nil {
+		if _, err := io.Copy(sums, io.NewSectionReader(file, 0, info.Size)); err != nil {
+			return fmt.Errorf("error hashing downloaded file: %w", err)
+		}
+	}
+
+	return verifyDownload(sums, info)
+}
+
+func verifyDownload(sums *checksums, info *remoteObjectInfo) error {
+	if sums == nil {
+		return nil
+	}
+	return sums.verify(info)
+}
+
+// downloadRange writes bytes start to end (inclusive) of the object into the
+// same offsets of file, retrying with a range that starts after the last byte
+// received. end is negative when the object size is unknown. When sums is not
+// nil the bytes are hashed as they are written, which requires the range to
+// be fetched in order. Received bytes are counted on progress and throttled
+// to limit.
+func downloadRange(ctx context.Context, url string, info *remoteObjectInfo, file *os.File, start, end int64, sums *checksums, progress *transferProgress, limit *bandwidthLimit) error {
+	offset := start
+
+	for attempt := 1; ; attempt++ {
+		written, err := fetchRange(ctx, url, info, file, offset, end, sums, progress, limit)
+		if err == nil {
+			return nil
+		}
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if attempt >= maxDownloadAttempts {
+			return fmt.Errorf("giving up after %d attempts: %w", attempt, err)
+		}
+
+		if info.AcceptsRanges {
+			offset += written
+		} else {
+			// The whole object is fetched again.
+			progress.add(-written)
+			if sums != nil {
+				sums.Reset()
+			}
+		}
+
+		mappingsLog.Warn("Download interrupted, retrying", "path", file.Name(), "offset", offset, "err", err)
+
+		select {
+		case <-time.After(downloadRetryDelay * (1 << (attempt - 1))):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func fetchRange(ctx context.Context, url string, info *remoteObjectInfo, file *os.File, offset, end int64, sums *checksums, progress *transferProgress, limit *bandwidthLimit) (int64, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return 0, fmt.Errorf("error creating request %v", err)
+	}
+	// The stored bytes are wanted, not a transparently decoded body.
+	req.Header.Set("Accept-Encoding", "identity")
+
+	if info.AcceptsRanges {
+		if end >= 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, end))
+		} else {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		}
+		// Fail instead of stitching together two versions of the object.
+		if info.ETag != "" {
+			req.Header.Set("If-Match", `"`+info.ETag+`"`)
+		}
+	}
+
+	resp, err := HTTPTransferClient.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("error downloading file: %v", err)
+	}
+	defer resp.Body.Close()
+
+	expectedStatus := http.StatusOK
+	if info.AcceptsRanges {
+		expectedStatus = http.StatusPartialContent
+	}
+	if resp.StatusCode != expectedStatus {
+		err := HandleHTTPError(resp)
+		return 0, fmt.Errorf("GET returned not okay status %v", err)
+	}
+
+	var dst io.Writer = io.NewOffsetWriter(file, offset)
+	if sums != nil {
+		dst = io.MultiWriter(dst, sums)
+	}
+
+	written, err := io.Copy(dst, progress.reader(limit.reader(ctx, resp.Body)))
+	if err != nil {
+		return written, err
+	}
+
+	if end >= 0 && offset+written != end+1 {
+		return written, io.ErrUnexpectedEOF
+	}
+
+	return written, nil
+}
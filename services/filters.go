@@ -0,0 +1,234 @@
+package services
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const regexPatternPrefix = "re:"
+
+// pathPattern is a glob, where "**" matches any number of path segments, or
+// a regular expression when written with the "re:" prefix. Patterns are
+// matched against slash-separated paths relative to the mapping source.
+type pathPattern struct {
+	glob string
+	re   *regexp.Regexp
+}
+
+func compilePathPattern(pattern string) (pathPattern, error) {
+	if strings.HasPrefix(pattern, regexPatternPrefix) {
+		re, err := regexp.Compile(strings.TrimPrefix(pattern, regexPatternPrefix))
+		if err != nil {
+			return pathPattern{}, fmt.Errorf("invalid regular expression %q: %v", pattern, err)
+		}
+		return pathPattern{re: re}, nil
+	}
+
+	pattern = strings.Trim(pattern, "/")
+	for _, segment := range strings.Split(pattern, "/") {
+		if _, err := path.Match(segment, ""); err != nil {
+			return pathPattern{}, fmt.Errorf("invalid glob %q: %v", pattern, err)
+		}
+	}
+
+	return pathPattern{glob: pattern}, nil
+}
+
+func (p pathPattern) match(name string) bool {
+	if p.re != nil {
+		return p.re.MatchString(name)
+	}
+	return matchGlob(p.glob, name)
+}
+
+// matchGlob matches name against a slash-separated glob in which "**" stands
+// for zero or more whole path segments.
+func matchGlob(pattern, name string) bool {
+	return matchGlobSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchGlobSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchGlobSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(name) == 0 {
+			return false
+		}
+
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+
+		pattern, name = pattern[1:], name[1:]
+	}
+
+	return len(name) == 0
+}
+
+// pathFilter selects paths by include and exclude patterns. An empty include
+// list selects everything; excludes win over includes.
+type pathFilter struct {
+	include []pathPattern
+	exclude []pathPattern
+}
+
+func newPathFilter(include, exclude []string) (*pathFilter, error) {
+	if len(include) == 0 && len(exclude) == 0 {
+		return nil, nil
+	}
+
+	f := &pathFilter{}
+
+	for _, pattern := range include {
+		compiled, err := compilePathPattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+		f.include = append(f.include, compiled)
+	}
+
+	for _, pattern := range exclude {
+		compiled, err := compilePathPattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+		f.exclude = append(f.exclude, compiled)
+	}
+
+	return f, nil
+}
+
+// Match reports whether the relative path name passes the filter. A nil
+// filter matches everything.
+func (f *pathFilter) Match(name string) bool {
+	if f == nil {
+		return true
+	}
+
+	for _, pattern := range f.exclude {
+		if pattern.match(name) {
+			return false
+		}
+	}
+
+	if len(f.include) == 0 {
+		return true
+	}
+
+	for _, pattern := range f.include {
+		if pattern.match(name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// splitGlobPrefix splits an accelerator path such as "project/runs/*.csv"
+// into the literal prefix to enumerate ("project/runs/") and the glob to apply
+// to the paths below it ("*.csv"). pattern is empty when path has no glob.
+func splitGlobPrefix(p string) (prefix, pattern string) {
+	segments := strings.Split(p, "/")
+
+	for i, segment := range segments {
+		if strings.ContainsAny(segment, "*?[") {
+			return strings.Join(segments[:i], "/") + "/", strings.Join(segments[i:], "/")
+		}
+	}
+
+	return p, ""
+}
+
+// Excludes reports whether name matches an exclude pattern. Walks use it to
+// skip whole directories.
+func (f *pathFilter) Excludes(name string) bool {
+	if f == nil {
+		return false
+	}
+
+	for _, pattern := range f.exclude {
+		if pattern.match(name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+const ignoreFileName = ".wkubeignore"
+
+// readIgnoreFile returns the exclude patterns in dir/.wkubeignore, or nil when
+// there is no such file. Lines follow a subset of the .gitignore rules: '#'
+// starts a comment, a pattern without a '/' matches at any depth, a trailing
+// '/' matches a directory and everything below it, and a leading '/' anchors
+// the pattern to dir. Negated patterns are not supported and are skipped.
+func readIgnoreFile(dir string) ([]string, error) {
+	data, err := os.ReadFile(filepath.Join(dir, ignoreFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %v", ignoreFileName, err)
+	}
+
+	patterns := []string{ignoreFileName}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "!") {
+			mappingsLog.Warn("Negated pattern is not supported, skipping", "file", ignoreFileName, "pattern", line)
+			continue
+		}
+
+		if strings.HasSuffix(line, "/") {
+			line += "**"
+		}
+
+		if strings.HasPrefix(line, "/") {
+			line = strings.TrimPrefix(line, "/")
+		} else if !strings.Contains(strings.TrimSuffix(line, "/**"), "/") {
+			line = "**/" + line
+		}
+
+		patterns = append(patterns, line)
+	}
+
+	return patterns, nil
+}
+
+// outputFilter combines the include and exclude options of an output mapping
+// with the .wkubeignore file found in its source directory. A mapping of a
+// single file has no such directory and keeps its options as they are.
+func outputFilter(mapping Mapping) (*pathFilter, error) {
+	if info, err := os.Stat(mapping.Source); err != nil || !info.IsDir() {
+		return mapping.filter, nil
+	}
+
+	ignored, err := readIgnoreFile(mapping.Source)
+	if err != nil {
+		return nil, err
+	}
+
+	if ignored == nil {
+		return mapping.filter, nil
+	}
+
+	exclude := append(append([]string{}, mapping.Options.Exclude...), ignored...)
+
+	return newPathFilter(mapping.Options.Include, exclude)
+}
@@ -0,0 +1,197 @@
+package services
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		want    bool
+	}{
+		{"*.csv", "a.csv", true},
+		{"*.csv", "dir/a.csv", false},
+		{"*.csv", "a.nc", false},
+		{"**/*.nc", "a.nc", true},
+		{"**/*.nc", "x/y/a.nc", true},
+		{"**/*.nc", "x/y/a.csv", false},
+		{"**/tmp/**", "tmp/a", true},
+		{"**/tmp/**", "x/tmp/y/a", true},
+		{"**/tmp/**", "x/tmpfile", false},
+		{"runs/**", "runs", true},
+		{"runs/**", "runs/1/out.csv", true},
+		{"runs/**", "other/runs/1", false},
+		{"run_?/out.csv", "run_1/out.csv", true},
+		{"run_?/out.csv", "run_10/out.csv", false},
+		{"[ab].txt", "b.txt", true},
+		{"[ab].txt", "c.txt", false},
+		{"a/**/b", "a/b", true},
+		{"a/**/b", "a/x/y/b", true},
+		{"a/**/b", "a/x/y/c", false},
+	}
+
+	for _, tt := range tests {
+		if got := matchGlob(tt.pattern, tt.name); got != tt.want {
+			t.Errorf("matchGlob(%q, %q) = %v, want %v", tt.pattern, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCompilePathPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		want    bool
+	}{
+		{"/runs/*.csv/", "runs/a.csv", true},
+		{`re:^run_\d+/`, "run_12/out.csv", true},
+		{`re:^run_\d+/`, "runs/out.csv", false},
+	}
+
+	for _, tt := range tests {
+		pattern, err := compilePathPattern(tt.pattern)
+		if err != nil {
+			t.Fatalf("compilePathPattern(%q): %v", tt.pattern, err)
+		}
+		if got := pattern.match(tt.name); got != tt.want {
+			t.Errorf("%q.match(%q) = %v, want %v", tt.pattern, tt.name, got, tt.want)
+		}
+	}
+
+	for _, invalid := range []string{"[a-", "re:(unclosed"} {
+		if _, err := compilePathPattern(invalid); err == nil {
+			t.Errorf("compilePathPattern(%q) succeeded, want an error", invalid)
+		}
+	}
+}
+
+func TestPathFilter(t *testing.T) {
+	filter, err := newPathFilter([]string{"**/*.nc", "*.csv"}, []string{"**/tmp/**"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"a.csv", true},
+		{"out/a.nc", true},
+		{"out/a.csv", false},
+		{"tmp/a.nc", false},
+		{"out/tmp/a.nc", false},
+		{"a.txt", false},
+	}
+
+	for _, tt := range tests {
+		if got := filter.Match(tt.name); got != tt.want {
+			t.Errorf("Match(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	if !filter.Excludes("out/tmp/x") || filter.Excludes("out/a.nc") {
+		t.Error("Excludes does not follow the exclude patterns")
+	}
+
+	var none *pathFilter
+	if !none.Match("anything") || none.Excludes("anything") {
+		t.Error("a nil filter must match everything and exclude nothing")
+	}
+}
+
+func TestSplitGlobPrefix(t *testing.T) {
+	tests := []struct {
+		path, prefix, pattern string
+	}{
+		{"project/runs/*.csv", "project/runs/", "*.csv"},
+		{"project/runs/**/out.nc", "project/runs/", "**/out.nc"},
+		{"project/run_?/out.nc", "project/", "run_?/out.nc"},
+		{"project/runs/", "project/runs/", ""},
+		{"project/runs/a.csv", "project/runs/a.csv", ""},
+	}
+
+	for _, tt := range tests {
+		prefix, pattern := splitGlobPrefix(tt.path)
+		if prefix != tt.prefix || pattern != tt.pattern {
+			t.Errorf("splitGlobPrefix(%q) = %q, %q, want %q, %q", tt.path, prefix, pattern, tt.prefix, tt.pattern)
+		}
+	}
+}
+
+func TestReadIgnoreFile(t *testing.T) {
+	dir := t.TempDir()
+	ignore := `# caches
+__pycache__/
+*.tmp
+/scratch
+/build/
+logs/*.log
+!keep.tmp
+
+`
+	if err := os.WriteFile(filepath.Join(dir, ignoreFileName), []byte(ignore), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	patterns, err := readIgnoreFile(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filter, err := newPathFilter(nil, patterns)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{ignoreFileName, false},
+		{"__pycache__/mod.pyc", false},
+		{"pkg/__pycache__/mod.pyc", false},
+		{"__pycache__.txt", true},
+		{"a.tmp", false},
+		{"deep/dir/a.tmp", false},
+		{"keep.tmp", false},
+		{"scratch", false},
+		{"out/scratch", true},
+		{"build/lib/a.so", false},
+		{"src/build/a.so", true},
+		{"logs/run.log", false},
+		{"logs/old/run.log", true},
+		{"sub/logs/run.log", true},
+		{"results/out.csv", true},
+	}
+
+	for _, tt := range tests {
+		if got := filter.Match(tt.name); got != tt.want {
+			t.Errorf("Match(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestReadIgnoreFileMissing(t *testing.T) {
+	patterns, err := readIgnoreFile(t.TempDir())
+	if err != nil || patterns != nil {
+		t.Errorf("got %q, %v, want no patterns", patterns, err)
+	}
+}
+
+func TestOutputFilterFileSource(t *testing.T) {
+	source := filepath.Join(t.TempDir(), "result.csv")
+	if err := os.WriteFile(source, []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	filter, err := outputFilter(Mapping{Source: source})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !filter.Match("result.csv") {
+		t.Error("a file source must not be filtered out")
+	}
+}
@@ -1,57 +1,118 @@
 package services
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 )
 
-func remoteCopy(source, destination string) error {
-	files, err := EnumerateFilesByPrefix(source)
+// fileTransfer is a single file moved by a mapping.
+type fileTransfer struct {
+	Source      string
+	Destination string
+}
+
+// planRemoteCopy enumerates the accelerator files of an input mapping,
+// applies its glob and filters, and resolves the local path each of them is
+// downloaded to.
+func planRemoteCopy(mapping Mapping) ([]fileTransfer, error) {
+	source, destination := mapping.Source, mapping.Destination
+
+	prefix, pattern := splitGlobPrefix(source)
+
+	files, err := EnumerateFilesByPrefix(prefix)
 	if err != nil {
-		return fmt.Errorf("error enumerating files- %v", err)
+		return nil, fmt.Errorf("error enumerating files- %v", err)
 	}
 
-	if len(files) > 1 && !strings.HasSuffix(destination, "/") {
-		return fmt.Errorf(
-			"error: mapping: %s:%s -- destination should end with '/' when mapping is from remote folder with multiple files. ",
-			source, destination)
-	}
+	var transfers []fileTransfer
 
 	for _, file := range files {
+		// Filters see the path relative to the mapping source, or the file
+		// name when the source is a single file.
+		relPath := strings.TrimPrefix(strings.TrimPrefix(file, prefix), "/")
+		filterPath := relPath
+		if filterPath == "" {
+			filterPath = path.Base(file)
+		}
+
+		if pattern != "" && !matchGlob(pattern, filterPath) {
+			continue
+		}
+
+		if !mapping.filter.Match(filterPath) {
+			continue
+		}
 
 		var destinationFile string
 
 		if strings.HasSuffix(destination, "/") {
 			// Construct the destination file path
-			relPath := strings.TrimPrefix(file, source)
-
-			relPath = strings.TrimPrefix(relPath, "/")
-
 			destinationFile = filepath.Join(destination, relPath)
 		} else {
 			destinationFile = destination
 		}
 
-		// Ensure the destination directory exists
-		if err := os.MkdirAll(filepath.Dir(destinationFile), os.ModePerm); err != nil {
-			return fmt.Errorf("error creating directory: %v", err)
-		}
+		transfers = append(transfers, fileTransfer{Source: file, Destination: destinationFile})
+	}
+
+	if len(transfers) > 1 && !strings.HasSuffix(destination, "/") {
+		return nil, fmt.Errorf(
+			"error: mapping: %s:%s -- destination should end with '/' when mapping is from remote folder with multiple files. ",
+			source, destination)
+	}
+
+	return transfers, nil
+}
+
+// remoteCopy enumerates the mapping source and queues one download per file on pool.
+func remoteCopy(pool *transferPool, mapping Mapping) error {
+	transfers, err := planRemoteCopy(mapping)
+	if err != nil {
+		return err
+	}
 
-		// Download the file
-		fmt.Fprintf(MultiLogWriter, "Downloading file: %s\n", file)
-		if err := DownloadFileFromRepo(file, destinationFile); err != nil {
-			return fmt.Errorf("error downloading file: %v", err)
+	for _, transfer := range transfers {
+		transfer := transfer
+
+		if mapping.Options.Archive != "" {
+			pool.Go(func(ctx context.Context) error {
+				mappingsLog.Info("Downloading archive", "path", transfer.Source)
+				if err := downloadAndExtract(ctx, ArchiveFormat(mapping.Options.Archive), transfer.Source, mapping.Destination); err != nil {
+					return fmt.Errorf("error extracting archive %s: %w", transfer.Source, err)
+				}
+				return nil
+			})
+			continue
 		}
+
+		pool.Go(func(ctx context.Context) error {
+			// Ensure the destination directory exists
+			if err := os.MkdirAll(filepath.Dir(transfer.Destination), os.ModePerm); err != nil {
+				return fmt.Errorf("error creating directory: %v", err)
+			}
+
+			// Download the file
+			mappingsLog.Info("Downloading file", "path", transfer.Source)
+			if err := DownloadFileFromRepo(ctx, transfer.Source, transfer.Destination); err != nil {
+				return fmt.Errorf("error downloading file %s: %w", transfer.Source, err)
+			}
+			return nil
+		})
 	}
 
 	return nil
 }
 
-func graphStorageCopy(source, destination string) error {
+// graphStorageCopy copies the source directory tree to destination, leaving
+// out the paths rejected by filter.
+func graphStorageCopy(source, destination string, filter *pathFilter) error {
 	srcInfo, err := os.Stat(source)
 	if err != nil {
 		return fmt.Errorf("source error: %w", err)
@@ -82,9 +143,16 @@ func graphStorageCopy(source, destination string) error {
 		destPath := filepath.Join(destination, relPath)
 
 		if info.IsDir() {
+			if relPath != "." && filter.Excludes(filepath.ToSlash(relPath)) {
+				return filepath.SkipDir
+			}
 			return os.MkdirAll(destPath, info.Mode())
 		}
 
+		if !filter.Match(filepath.ToSlash(relPath)) {
+			return nil
+		}
+
 		// Copy file
 		return copyFile(path, destPath, info.Mode())
 	})
@@ -111,8 +179,10 @@ func copyFile(src, dst string, mode os.FileMode) error {
 	return nil
 }
 
-func remotePush(source, destination string) error {
-
+// walkOutputSource calls fn for every file of an output source, a single file
+// or a directory tree, with the remote path it maps to. Paths rejected by
+// filter are left out.
+func walkOutputSource(source, destination string, filter *pathFilter, fn func(localPath, destPath string, info os.FileInfo) error) error {
 	destination = strings.TrimRight(destination, string(os.PathSeparator))
 
 	info, err := os.Stat(source)
@@ -121,21 +191,31 @@ func remotePush(source, destination string) error {
 	}
 
 	if !info.IsDir() {
-		if err := UploadFile(source, destination); err != nil {
-			return err
-		}
-		return nil
+		return fn(source, destination, info)
 	}
 
 	return filepath.WalkDir(source, func(path string, d os.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
+
+		relPath, err := filepath.Rel(source, path)
+		if err != nil {
+			return err
+		}
+
 		if d.IsDir() {
+			if relPath != "." && filter.Excludes(filepath.ToSlash(relPath)) {
+				return filepath.SkipDir
+			}
 			return nil
 		}
 
-		relPath, err := filepath.Rel(source, path)
+		if !filter.Match(filepath.ToSlash(relPath)) {
+			return nil
+		}
+
+		info, err := d.Info()
 		if err != nil {
 			return err
 		}
@@ -143,16 +223,75 @@ func remotePush(source, destination string) error {
 		// Join paths safely, ensuring no double slashes
 		destPath := filepath.Join(destination, relPath)
 
-		if err := UploadFile(path, destPath); err != nil {
+		return fn(path, destPath, info)
+	})
+}
+
+// remotePush uploads the mapping source, a file or a directory tree, to the
+// job output folder at the mapping destination, leaving out the paths
+// rejected by filter. Files already uploaded unchanged by the checkpointer
+// are skipped, and so are, in sync mode, files whose remote copy is unchanged.
+// Files are uploaded upload_concurrency at a time.
+func remotePush(ctx context.Context, mapping Mapping, filter *pathFilter) error {
+	var syncState *outputSync
+	if mapping.Options.Sync {
+		var err error
+		if syncState, err = newOutputSync(mapping.Destination); err != nil {
 			return err
 		}
+	}
+
+	pool := newTransferPool(ctx, getenvInt("upload_concurrency", defaultUploadConcurrency))
+
+	err := walkOutputSource(mapping.Source, mapping.Destination, filter, func(localPath, destPath string, info os.FileInfo) error {
+		if uploadedOutputs.unchanged(localPath, destPath, info) {
+			return nil
+		}
+
+		pool.Go(func(ctx context.Context) error {
+			if syncState != nil {
+				unchanged, err := syncState.unchanged(ctx, localPath, destPath)
+				if err != nil {
+					return err
+				}
+				if unchanged {
+					mappingsLog.Debug("Skipping unchanged file", "path", localPath)
+					jobManifest.add(manifestEntry{
+						LocalPath:  localPath,
+						RemotePath: destPath,
+						Mapping:    mapping.String(),
+						Status:     "unchanged",
+						Size:       info.Size(),
+					})
+					return nil
+				}
+			}
+
+			return pushOutputFile(ctx, mapping, localPath, destPath, info)
+		})
 		return nil
 	})
+	if err != nil {
+		pool.fail(err)
+	}
+
+	return pool.Wait()
+}
+
+// pushOutputFile uploads a single output file and records it in the upload
+// ledger and the job manifest.
+func pushOutputFile(ctx context.Context, mapping Mapping, localPath, destPath string, info os.FileInfo) error {
+	started := time.Now()
 
-	// if err := UploadFile(source, destination); err != nil {
-	// 	return err
-	// }
-	// return nil
+	result, err := uploadFile(ctx, localPath, destPath, mapping.Options.Compress)
+	if err != nil {
+		return err
+	}
+
+	uploadedOutputs.record(localPath, destPath, info)
+	jobManifest.addUpload(mapping, localPath, destPath, result, started)
+
+	return nil
 }
 
 func inputMappingFromMountedStorage(source, destination string) error {
@@ -215,344 +354,255 @@ func inputMappingFromMountedStorage(source, destination string) error {
 
 func outputMappingToMountedStorage(source, destination string) error {
 
-	fmt.Printf("Performing output mapping to mounted source using inputMappingFromMountedStorage by switching source and destination.\n")
+	mappingsLog.Debug("Performing output mapping to mounted source using inputMappingFromMountedStorage by switching source and destination")
 
 	// Same logic as input mapping as it will be done together that is before the job states.
 	// source and destination with respect to output mapping has already been changed by callee
 	return inputMappingFromMountedStorage(source, destination)
 }
 
-func processInputMappings(inputMappings []string) ([]func() error, []func() error, error) {
-
-	var taskQueue []func() error
-
-	var symlinkQueue []func() error
-
-	for _, inputMapping := range inputMappings {
-		inputMapping = strings.TrimSpace(inputMapping)
-		if inputMapping == "" {
-			continue
-		}
-
-		inputMappingNew := strings.Replace(inputMapping, "acc://", "__acc__", 1)
-		splittedInputMapping := strings.Split(inputMappingNew, ":")
-		if len(splittedInputMapping) != 2 {
-			return nil, nil, fmt.Errorf("error: invalid input mapping syntax")
-		}
-
-		source := splittedInputMapping[0]
-		destination := splittedInputMapping[1]
-
-		if !strings.HasPrefix(source, "__acc__") &&
-			!strings.HasPrefix(source, "/mnt/pipe") &&
-			!strings.HasPrefix(source, "/mnt/graph") &&
-			source != "selected_files" &&
-			source != "selected_folders" {
-			return nil, nil, fmt.Errorf("error: invalid source in input mappings %s:%s", source, destination)
-		}
-
-		if source == "selected_folders" {
-			if destination == "" {
-				return nil, nil, fmt.Errorf("error: destination for selected_folders mapping should be defined")
+// expandSelectedInputs turns a selected_files or selected_folders mapping into
+// one accelerator mapping per selection made in the job submission.
+func expandSelectedInputs(m Mapping) ([]Mapping, error) {
+	var newMappings []Mapping
+
+	if m.Kind == MappingKindSelectedFolders {
+		selectedFoldersFromEnv := os.Getenv("selected_foldernames")
+
+		if selectedFoldersFromEnv == "" {
+			mappingsLog.Warn("selected_folders referenced in source but no folder selection detected")
+			return nil, nil
+		}
+
+		for _, selectedFolder := range strings.Split(selectedFoldersFromEnv, ",") {
+			if selectedFolder != "" {
+				newMappings = append(newMappings, Mapping{
+					Source:      selectedFolder,
+					Destination: m.Destination,
+					Kind:        MappingKindAccelerator,
+					Options:     m.Options,
+					raw:         m.raw,
+					filter:      m.filter,
+				})
 			}
+		}
 
-			selectedFoldersFromEnv := os.Getenv("selected_foldernames")
-
-			if selectedFoldersFromEnv == "" {
-				fmt.Fprintln(MultiLogWriter, "warning: selected_folders referenced in source but no folder selection detected")
-				continue
-			} else {
-				selectedFolders := strings.Split(selectedFoldersFromEnv, ",")
-
-				var newMappings []string
+		return newMappings, nil
+	}
 
-				for _, selectedFolder := range selectedFolders {
+	// if the destination ends with / then move all the files to that folder
+	// if ends with not / and too many files selected -- raise error only one file should be selected
+	selectedFilesFromEnv := os.Getenv("selected_filenames")
 
-					if selectedFolder != "" {
-						newMapping := fmt.Sprintf("acc://%s:%s", selectedFolder, destination)
-						newMappings = append(newMappings, newMapping)
-					}
-				}
+	if selectedFilesFromEnv == "" {
+		mappingsLog.Warn("selected_files referenced in source but no file selection detected")
+		return nil, nil
+	}
 
-				nestedSelectedFolderTaskQueue, _, err := processInputMappings(newMappings)
+	selectedFiles := strings.Split(selectedFilesFromEnv, ",")
 
-				if err != nil {
-					return nil, nil, err
+	if strings.HasSuffix(m.Destination, "/") {
+		for _, selectedFile := range selectedFiles {
+			if selectedFile != "" {
+				destination := fmt.Sprintf("%s%s", m.Destination, selectedFile)
+				if m.Options.Archive != "" {
+					// Selected archives are all extracted into the destination.
+					destination = m.Destination
 				}
 
-				taskQueue = append(taskQueue, nestedSelectedFolderTaskQueue...)
+				newMappings = append(newMappings, Mapping{
+					Source:      selectedFile,
+					Destination: destination,
+					Kind:        MappingKindAccelerator,
+					Options:     m.Options,
+					raw:         m.raw,
+					filter:      m.filter,
+				})
 			}
-
 		}
+	} else {
+		if len(selectedFiles) > 1 {
+			return nil, fmt.Errorf("error: when destination is file (without '/'), there should only be one selected file")
+		}
+		if selectedFiles[0] != "" {
+			newMappings = append(newMappings, Mapping{
+				Source:      selectedFiles[0],
+				Destination: m.Destination,
+				Kind:        MappingKindAccelerator,
+				Options:     m.Options,
+				raw:         m.raw,
+				filter:      m.filter,
+			})
+		}
+	}
 
-		if source == "selected_files" {
-			// first of all destination should not be empty
-			// if the destination ends with / then move all the files to that folder also check what happens in other cases
-			// if ends with not / and too many files selected -- raise error only one file should be selected
-
-			if destination == "" {
-				return nil, nil, fmt.Errorf("error: destination for selected_files mapping should be defined")
-			}
-
-			selectedFilesFromEnv := os.Getenv("selected_filenames")
-
-			if selectedFilesFromEnv == "" {
-				fmt.Fprintln(MultiLogWriter, "warning: selected_files referenced in source but no file selection detected")
-				continue
-			} else {
-				selectedFiles := strings.Split(selectedFilesFromEnv, ",")
-
-				var newMappings []string
-
-				if strings.HasSuffix(destination, "/") {
+	return newMappings, nil
+}
 
-					for _, selectedFile := range selectedFiles {
+// mappingTask prepares a mapping and queues its transfers on the pool.
+type mappingTask func(pool *transferPool) error
 
-						if selectedFile != "" {
-							newDestination := fmt.Sprintf("%s%s", destination, selectedFile)
-							newMapping := fmt.Sprintf("acc://%s:%s", selectedFile, newDestination)
-							newMappings = append(newMappings, newMapping)
-						}
-					}
-				} else {
-
-					if len(selectedFiles) > 1 {
-						return nil, nil, fmt.Errorf("error: when destination is file (without '/'), there should only be one selected file")
-					} else {
-						if selectedFiles[0] != "" {
-							newMapping := fmt.Sprintf("acc://%s:%s", selectedFiles[0], destination)
-							newMappings = append(newMappings, newMapping)
-						}
-					}
-				}
+func processInputMappings(inputMappings []Mapping) ([]mappingTask, []func() error, error) {
 
-				nestedSelectedfileTaskQueue, _, err := processInputMappings(newMappings)
+	var taskQueue []mappingTask
 
-				if err != nil {
-					return nil, nil, err
-				}
+	var symlinkQueue []func() error
 
-				taskQueue = append(taskQueue, nestedSelectedfileTaskQueue...)
-			}
-		}
+	for _, inputMapping := range inputMappings {
+		mapping := inputMapping
 
-		if destination == "" {
-			if strings.HasPrefix(source, "__acc__") {
-				destination = "/" + strings.TrimPrefix(source, "__acc__")
+		switch mapping.Kind {
+		case MappingKindSelectedFiles, MappingKindSelectedFolders:
+			newMappings, err := expandSelectedInputs(mapping)
+			if err != nil {
+				return nil, nil, err
 			}
-		}
 
-		if strings.HasSuffix(destination, "/*") {
-			if strings.HasPrefix(source, "__acc__") {
-				destination = strings.TrimSuffix(destination, "/*") + "/" + strings.TrimPrefix(source, "__acc__")
+			nestedTaskQueue, _, err := processInputMappings(newMappings)
+			if err != nil {
+				return nil, nil, err
 			}
-		}
 
-		if !strings.HasPrefix(destination, "/") {
-			return nil, nil, fmt.Errorf("error: invalid destination path: always use absolute path")
-		}
-
-		if strings.HasPrefix(source, "/mnt/pipe") {
-			symlinkQueue = append(taskQueue, func() error {
-				if err := inputMappingFromMountedStorage(source, destination); err != nil {
-					return err
+			taskQueue = append(taskQueue, nestedTaskQueue...)
+		case MappingKindPipe:
+			symlinkQueue = append(symlinkQueue, func() error {
+				if skipMissingSource(mapping, mapping.Source) {
+					return nil
 				}
-				return nil
+				return inputMappingFromMountedStorage(mapping.Source, mapping.Destination)
 			})
-		} else if strings.HasPrefix(source, "/mnt/graph") {
-			taskQueue = append(taskQueue, func() error {
-				if err := graphStorageCopy(source, destination); err != nil {
-					return err
-				}
+		case MappingKindGraph:
+			taskQueue = append(taskQueue, func(pool *transferPool) error {
+				pool.Go(func(ctx context.Context) error {
+					if skipMissingSource(mapping, mapping.Source) {
+						return nil
+					}
+					return graphStorageCopy(mapping.Source, mapping.Destination, mapping.filter)
+				})
 				return nil
 			})
-		} else if strings.HasPrefix(source, "__acc__") {
-			source = strings.TrimPrefix(source, "__acc__")
-			taskQueue = append(taskQueue, func() error {
-				if err := remoteCopy(source, destination); err != nil {
-					return err
-				}
-				return nil
+		case MappingKindAccelerator:
+			taskQueue = append(taskQueue, func(pool *transferPool) error {
+				return remoteCopy(pool, mapping)
 			})
 		}
 	}
 	return taskQueue, symlinkQueue, nil
 }
 
-func preProcessOutputMappings(outputMappings []string) ([]func() error, error) {
+func preProcessOutputMappings(outputMappings []Mapping) ([]func() error, error) {
 	var symlinkQueue []func() error
-	// Process output mappings
-	for _, outputMapping := range outputMappings {
-		outputMapping = strings.TrimSpace(outputMapping)
-		if outputMapping == "" {
-			continue
-		}
-
-		outputMappingNew := strings.Replace(outputMapping, "acc://", "__acc__", 1)
-		splittedOutputMapping := strings.Split(outputMappingNew, ":")
-		if len(splittedOutputMapping) != 2 {
-			return nil, fmt.Errorf("error: invalid output mapping syntax")
-		}
-
-		source := splittedOutputMapping[0]
-		destination := splittedOutputMapping[1]
-
-		if strings.HasPrefix(source, "__acc__") {
-			return nil, fmt.Errorf("error: invalid source in output mappings")
-		}
-
-		if !strings.HasPrefix(source, "/") {
-			return nil, fmt.Errorf("error: please use absolute URI for source")
-		}
-
-		if !strings.HasPrefix(destination, "__acc__") &&
-			!strings.HasPrefix(destination, "/mnt/pipe") &&
-			!strings.HasPrefix(destination, "/mnt/graph") {
-			return nil, fmt.Errorf("error: invalid destination in output mappings")
-		}
 
-		if destination == "" {
-			destination = "__acc__" + source
-		}
+	for _, outputMapping := range outputMappings {
+		mapping := outputMapping
 
-		if strings.HasPrefix(destination, "/mnt/pipe") {
+		if mapping.Kind == MappingKindPipe {
 			symlinkQueue = append(symlinkQueue, func() error {
-				if err := outputMappingToMountedStorage(destination, source); err != nil {
-					return err
-				}
-				return nil
+				return outputMappingToMountedStorage(mapping.Destination, mapping.Source)
 			})
 		}
 	}
 	return symlinkQueue, nil
 }
 
-func postProcessOutputMappings(outputMappings []string) ([]func() error, error) {
+func postProcessOutputMappings(outputMappings []Mapping) ([]func() error, error) {
 	var taskQueue []func() error
-	// Process output mappings
-	for _, outputMapping := range outputMappings {
-		outputMapping = strings.TrimSpace(outputMapping)
-		if outputMapping == "" {
-			continue
-		}
-
-		outputMappingNew := strings.Replace(outputMapping, "acc://", "__acc__", 1)
-		splittedOutputMapping := strings.Split(outputMappingNew, ":")
-		if len(splittedOutputMapping) != 2 {
-			return nil, fmt.Errorf("error: invalid output mapping syntax")
-		}
-
-		source := splittedOutputMapping[0]
-		destination := splittedOutputMapping[1]
-
-		if strings.HasPrefix(source, "__acc__") {
-			return nil, fmt.Errorf("error: invalid source in output mappings")
-		}
 
-		if !strings.HasPrefix(source, "/") {
-			return nil, fmt.Errorf("error: please use absolute URI for source")
-		}
-
-		if !strings.HasPrefix(destination, "__acc__") &&
-			!strings.HasPrefix(destination, "/mnt/pipe") &&
-			!strings.HasPrefix(destination, "/mnt/graph") {
-			return nil, fmt.Errorf("error: invalid destination in output mappings")
-		}
-
-		if destination == "" {
-			destination = "__acc__" + source
-		}
+	for _, outputMapping := range outputMappings {
+		mapping := outputMapping
 
-		if strings.HasPrefix(destination, "__acc__") {
-			destination = strings.TrimPrefix(destination, "__acc__")
+		switch mapping.Kind {
+		case MappingKindAccelerator:
 			taskQueue = append(taskQueue, func() error {
-				if err := remotePush(source, destination); err != nil {
+				if skipMissingSource(mapping, mapping.Source) {
+					return nil
+				}
+				filter, err := outputFilter(mapping)
+				if err != nil {
 					return err
 				}
-				return nil
+				// Outputs are pushed even when the job was cancelled.
+				if mapping.Options.Archive != "" {
+					return pushArchive(context.Background(), mapping, filter)
+				}
+				return remotePush(context.Background(), mapping, filter)
 			})
-		} else if strings.HasPrefix(destination, "/mnt/graph") {
+		case MappingKindGraph:
 			taskQueue = append(taskQueue, func() error {
-				if err := graphStorageCopy(source, destination); err != nil {
+				if skipMissingSource(mapping, mapping.Source) {
+					return nil
+				}
+				filter, err := outputFilter(mapping)
+				if err != nil {
 					return err
 				}
-				return nil
+				return graphStorageCopy(mapping.Source, mapping.Destination, filter)
 			})
 		}
 	}
 	return taskQueue, nil
 }
 
-func PreProcessMappings() error {
-
-	fmt.Fprintln(MultiLogWriter, "Pre process input/output mappings started")
+func PreProcessMappings(ctx context.Context) error {
 
-	inputMappings := os.Getenv("input_mappings")
-	inputMappings = os.ExpandEnv(inputMappings)
-	outputMappings := os.Getenv("output_mappings")
-	outputMappings = os.ExpandEnv(outputMappings)
+	mappingsLog.Info("Pre process input/output mappings started")
 
-	allInputMappings := strings.Split(inputMappings, ";")
-	allOutputMappings := strings.Split(outputMappings, ";")
+	spec, err := LoadMappingSpec()
+	if err != nil {
+		return fmt.Errorf("error: error loading mappings %v", err)
+	}
 
-	taskQueue, symlinkQueueFromInputMapping, err := processInputMappings(allInputMappings)
+	taskQueue, symlinkQueueFromInputMapping, err := processInputMappings(spec.Inputs)
 
 	if err != nil {
 		return fmt.Errorf("error: error preparing input mappings %v", err)
 	}
 
-	symlinkQueueFromOutputMapping, err := preProcessOutputMappings(allOutputMappings)
+	symlinkQueueFromOutputMapping, err := preProcessOutputMappings(spec.Outputs)
 
 	if err != nil {
 		return fmt.Errorf("error: error preparing pre processing task queue %v", err)
 	}
 
-	var finalTaskQueue []func() error
-	finalTaskQueue = append(finalTaskQueue, symlinkQueueFromInputMapping...)
-	finalTaskQueue = append(finalTaskQueue, symlinkQueueFromOutputMapping...)
-	finalTaskQueue = append(finalTaskQueue, taskQueue...)
+	var symlinkQueue []func() error
+	symlinkQueue = append(symlinkQueue, symlinkQueueFromInputMapping...)
+	symlinkQueue = append(symlinkQueue, symlinkQueueFromOutputMapping...)
 
-	errChan := make(chan error, 1)
+	// Symlinks are cheap and may be the parents of download destinations,
+	// so they are created before any transfer starts.
+	for _, task := range symlinkQueue {
+		if err := task(); err != nil {
+			return fmt.Errorf("pre process input/output mappings: %w", err)
+		}
+	}
 
-	var wg sync.WaitGroup
+	pool := newTransferPool(ctx, getenvInt("download_concurrency", defaultDownloadConcurrency))
 
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		for _, task := range finalTaskQueue {
-			err := task()
-			if err != nil {
-				errChan <- err
-				close(errChan)
-				return
-			}
+	for _, task := range taskQueue {
+		if err := task(pool); err != nil {
+			pool.fail(err)
+			break
 		}
-	}()
-	wg.Wait()
+	}
 
-	select {
-	case err := <-errChan:
-		if err != nil {
-			return fmt.Errorf("pre process input/output mappings: %w", err)
-		}
-	default:
-		// No error occurred, continue
+	if err := pool.Wait(); err != nil {
+		return fmt.Errorf("pre process input/output mappings: %w", err)
 	}
 
-	fmt.Fprintln(MultiLogWriter, "Pre process input/output mappings completed")
+	mappingsLog.Info("Pre process input/output mappings completed")
 
 	return nil
 }
 
 func PostProcessMappings() error {
-	fmt.Fprintln(MultiLogWriter, "Post process output mappings started ")
-
-	outputMappings := os.Getenv("output_mappings")
-	outputMappings = os.ExpandEnv(outputMappings)
+	mappingsLog.Info("Post process output mappings started")
 
-	allOutputMappings := strings.Split(outputMappings, ";")
+	spec, err := LoadMappingSpec()
+	if err != nil {
+		return fmt.Errorf("error: error loading mappings %v", err)
+	}
 
-	taskQueue, err := postProcessOutputMappings(allOutputMappings)
+	taskQueue, err := postProcessOutputMappings(spec.Outputs)
 
 	if err != nil {
 		return fmt.Errorf("error: error preparing post processing task queue %v", err)
@@ -576,16 +626,38 @@ func PostProcessMappings() error {
 	}()
 	wg.Wait()
 
+	var taskErr error
 	select {
-	case err := <-errChan:
-		if err != nil {
-			return fmt.Errorf("post processing failed: %w", err)
-		}
+	case taskErr = <-errChan:
 	default:
 		// No error occurred, continue
 	}
 
-	fmt.Fprintln(MultiLogWriter, "Post process output mappings completed")
+	// The manifest is uploaded even when a mapping failed, marked incomplete,
+	// so that whatever did get uploaded is accounted for.
+	if hasAcceleratorOutputs(spec.Outputs) {
+		if err := uploadOutputManifest(taskErr == nil); err != nil {
+			if taskErr == nil {
+				return fmt.Errorf("post processing failed: %w", err)
+			}
+			mappingsLog.Error("Error uploading output manifest", "err", err)
+		}
+	}
+
+	if taskErr != nil {
+		return fmt.Errorf("post processing failed: %w", taskErr)
+	}
+
+	mappingsLog.Info("Post process output mappings completed")
 
 	return nil
 }
+
+func hasAcceleratorOutputs(outputMappings []Mapping) bool {
+	for _, mapping := range outputMappings {
+		if mapping.Kind == MappingKindAccelerator {
+			return true
+		}
+	}
+	return false
+}
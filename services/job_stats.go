@@ -9,9 +9,6 @@ import (
 	"time"
 )
 
-// You must have this defined somewhere in your package:
-// var MultiLogWriter io.Writer
-
 func bytesToGB(b uint64) float64 {
 	return float64(b) / (1024 * 1024 * 1024)
 }
@@ -152,7 +149,7 @@ func VerboseResourceReport() error {
 	diskUsageBytes, _ := strconv.ParseUint(duFields[0], 10, 64)
 
 	// ------------------ Print Report -------------------
-	w := MultiLogWriter
+	w := new(strings.Builder)
 	fmt.Fprintf(w, "\n📊 Resource Usage Report:\n")
 
 	fmt.Fprintf(w, "\n🧠 Memory:\n")
@@ -193,5 +190,8 @@ func VerboseResourceReport() error {
 		fmt.Fprintf(w, "- Pod/container uptime:      %s\n", uptime.Round(time.Second))
 	}
 
+	// The report is logged as a whole, one record per line.
+	healthLog.Info(w.String())
+
 	return nil
 }
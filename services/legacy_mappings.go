@@ -0,0 +1,174 @@
+package services
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// MappingParseError reports a syntax error in the legacy mapping grammar.
+// Offset is the character offset of the problem within Mapping.
+type MappingParseError struct {
+	Mapping string
+	Offset  int
+	Reason  string
+}
+
+func (e *MappingParseError) Error() string {
+	return fmt.Sprintf("mapping %q at offset %d: %s", e.Mapping, e.Offset, e.Reason)
+}
+
+// legacyMappingParser tokenizes the "acc://src:/dst;/src:acc://dst" syntax.
+// Mappings are separated by ';' and source and destination by ':'. Either
+// character can be part of a path when escaped with a backslash or when the
+// path starts with a single or double quote. Inside double quotes a backslash
+// still escapes the next character; single quotes are taken literally. Quotes
+// further into a path are ordinary characters, as they were before quoting
+// was supported. The acc:// scheme at the start of a path is never treated as
+// a separator.
+type legacyMappingParser struct {
+	input []rune
+	pos   int
+	start int
+}
+
+// parseLegacyMappings parses the legacy mapping string from the environment.
+func parseLegacyMappings(raw string) ([]Mapping, error) {
+	p := &legacyMappingParser{input: []rune(raw)}
+
+	var mappings []Mapping
+
+	for p.pos < len(p.input) {
+		mapping, err := p.parseMapping()
+		if err != nil {
+			return nil, err
+		}
+		if mapping != nil {
+			mappings = append(mappings, *mapping)
+		}
+	}
+
+	return mappings, nil
+}
+
+func (p *legacyMappingParser) errorf(pos int, format string, args ...interface{}) error {
+	end := pos
+	for end < len(p.input) && p.input[end] != ';' {
+		end++
+	}
+
+	return &MappingParseError{
+		Mapping: string(p.input[p.start:end]),
+		Offset:  pos - p.start,
+		Reason:  fmt.Sprintf(format, args...),
+	}
+}
+
+// parseMapping consumes one mapping up to and including the next unquoted
+// ';'. It returns nil for empty mappings.
+func (p *legacyMappingParser) parseMapping() (*Mapping, error) {
+	p.start = p.pos
+
+	var fields []string
+	var field strings.Builder
+	// trailing counts unquoted, unescaped whitespace at the end of field so
+	// that it can be trimmed like the old strings.TrimSpace did.
+	trailing := 0
+	atFieldStart := true
+	empty := true
+
+	endField := func() {
+		value := field.String()
+		fields = append(fields, value[:len(value)-trailing])
+		field.Reset()
+		trailing = 0
+		atFieldStart = true
+	}
+
+	for ; p.pos < len(p.input); p.pos++ {
+		c := p.input[p.pos]
+
+		if atFieldStart {
+			if unicode.IsSpace(c) {
+				continue
+			}
+			if strings.HasPrefix(string(p.input[p.pos:]), accPrefix) {
+				field.WriteString(accPrefix)
+				p.pos += len(accPrefix) - 1
+				atFieldStart = false
+				empty = false
+				continue
+			}
+		}
+
+		if c == ';' {
+			p.pos++
+			break
+		}
+
+		quotable := atFieldStart
+		atFieldStart = false
+		empty = false
+
+		switch c {
+		case '\\':
+			if p.pos+1 >= len(p.input) {
+				return nil, p.errorf(p.pos, "dangling escape character at end of input")
+			}
+			p.pos++
+			field.WriteRune(p.input[p.pos])
+			trailing = 0
+		case '"', '\'':
+			if !quotable {
+				field.WriteRune(c)
+				trailing = 0
+				break
+			}
+			quoteStart := p.pos
+			for p.pos++; p.pos < len(p.input) && p.input[p.pos] != c; p.pos++ {
+				if c == '"' && p.input[p.pos] == '\\' && p.pos+1 < len(p.input) {
+					p.pos++
+				}
+				field.WriteRune(p.input[p.pos])
+			}
+			if p.pos >= len(p.input) {
+				return nil, p.errorf(quoteStart, "unterminated %c quote", c)
+			}
+			trailing = 0
+		case ':':
+			if len(fields) > 0 {
+				return nil, p.errorf(p.pos, "unexpected ':' in destination, escape it as '\\:' or quote the path")
+			}
+			endField()
+		default:
+			field.WriteRune(c)
+			if unicode.IsSpace(c) {
+				trailing += len(string(c))
+			} else {
+				trailing = 0
+			}
+		}
+	}
+
+	end := p.pos
+	if end > p.start && end <= len(p.input) && p.input[end-1] == ';' {
+		end--
+	}
+	raw := strings.TrimSpace(string(p.input[p.start:end]))
+
+	if empty && len(fields) == 0 {
+		return nil, nil
+	}
+
+	if len(fields) == 0 {
+		return nil, p.errorf(end, "missing ':' between source and destination")
+	}
+
+	endField()
+
+	return &Mapping{
+		Source:      fields[0],
+		Destination: fields[1],
+		raw:         raw,
+	}, nil
+}
@@ -0,0 +1,86 @@
+package services
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseLegacyMappings(t *testing.T) {
+	type pair struct{ source, destination string }
+
+	tests := []struct {
+		name string
+		raw  string
+		want []pair
+	}{
+		{"single", "acc://project/in:/data", []pair{{"acc://project/in", "/data"}}},
+		{"several", "acc://p/a:/a;acc://p/b:/b", []pair{{"acc://p/a", "/a"}, {"acc://p/b", "/b"}}},
+		{"empty mappings", ";acc://p/a:/a;;", []pair{{"acc://p/a", "/a"}}},
+		{"surrounding whitespace", "  acc://p/a : /a  ; /out:acc://p/out ", []pair{{"acc://p/a", "/a"}, {"/out", "acc://p/out"}}},
+		{"output mapping", "/results:acc://p/results", []pair{{"/results", "acc://p/results"}}},
+		{"escaped colon", `acc://p/run_12\:30:/data`, []pair{{"acc://p/run_12:30", "/data"}}},
+		{"escaped semicolon", `/out\;1:acc://p/out`, []pair{{"/out;1", "acc://p/out"}}},
+		{"escaped backslash", `/out\\:acc://p/out`, []pair{{`/out\`, "acc://p/out"}}},
+		{"double quotes", `"acc://p/run_12:30":/data`, []pair{{"acc://p/run_12:30", "/data"}}},
+		{"apostrophe in path", `acc://proj/John's run/:/data/`, []pair{{"acc://proj/John's run/", "/data/"}}},
+		{"quotes inside a path", `/out/"a":acc://p/b'c'`, []pair{{`/out/"a"`, "acc://p/b'c'"}}},
+		{"quoted path", `"acc://p/a;b:c/d":/data`, []pair{{"acc://p/a;b:c/d", "/data"}}},
+		{"escape inside double quotes", `"acc://p/a\"b":/data`, []pair{{`acc://p/a"b`, "/data"}}},
+		{"single quotes are literal", `'/out\x':acc://p/out`, []pair{{`/out\x`, "acc://p/out"}}},
+		{"quoted whitespace is kept", `" /out ":acc://p/out`, []pair{{" /out ", "acc://p/out"}}},
+		{"quoted destination", `acc://p/a:"/data/12:30"`, []pair{{"acc://p/a", "/data/12:30"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mappings, err := parseLegacyMappings(tt.raw)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []pair
+			for _, m := range mappings {
+				got = append(got, pair{m.Source, m.Destination})
+			}
+
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("mapping %d = %q, want %q", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestParseLegacyMappingsErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     string
+		mapping string
+		offset  int
+	}{
+		{"dangling escape", `acc://p/a:/data\`, `acc://p/a:/data\`, 15},
+		{"unterminated double quote", `acc://p/a:"/data`, `acc://p/a:"/data`, 10},
+		{"unterminated single quote", `'/out:acc://p/out`, `'/out:acc://p/out`, 0},
+		{"missing separator", "acc://p/a:/a;/out", "/out", 4},
+		{"colon in destination", "acc://p/a:/data/12:30", "acc://p/a:/data/12:30", 18},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseLegacyMappings(tt.raw)
+
+			var parseErr *MappingParseError
+			if !errors.As(err, &parseErr) {
+				t.Fatalf("got %v, want a MappingParseError", err)
+			}
+			if parseErr.Mapping != tt.mapping || parseErr.Offset != tt.offset {
+				t.Errorf("got mapping %q at offset %d, want %q at offset %d",
+					parseErr.Mapping, parseErr.Offset, tt.mapping, tt.offset)
+			}
+		})
+	}
+}
@@ -0,0 +1,277 @@
+package services
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A line longer than maxLogLineBytes is cut into several records.
+const maxLogLineBytes = 64 * 1024
+
+// An unterminated line, e.g. a progress bar redrawn with \r, is emitted as it
+// is once no newline has followed for partialLineTimeout.
+var partialLineTimeout = 2 * time.Second
+
+// logStream is the origin of a log line.
+type logStream string
+
+const (
+	streamStdout logStream = "stdout"
+	streamStderr logStream = "stderr"
+	streamAgent  logStream = "agent"
+)
+
+// Sources of log lines: the job command, or the agent subsystem that wrote
+// the message.
+const (
+	sourceJob      = "job"
+	sourceAgent    = "agent"
+	sourceMappings = "mappings"
+	sourceTunnel   = "tunnel"
+	sourceHealth   = "health"
+)
+
+// Levels of agent messages. The job's output has no level; its stream tells
+// stdout from stderr.
+const (
+	levelDebug = "debug"
+	levelInfo  = "info"
+	levelWarn  = "warn"
+	levelError = "error"
+)
+
+// logRecord is a single line of the job log.
+type logRecord struct {
+	Seq     uint64    `json:"seq,omitempty"`
+	Time    time.Time `json:"timestamp"`
+	Stream  logStream `json:"stream"`
+	Level   string    `json:"level,omitempty"`
+	Source  string    `json:"source"`
+	Message string    `json:"message"`
+
+	// Attrs are the key-value pairs an agent message was logged with.
+	Attrs map[string]any `json:"attrs,omitempty"`
+}
+
+// text renders the record as a line of the local log. The job's output is
+// kept as it is; agent messages are prefixed with their component and level
+// and followed by their attributes.
+func (r logRecord) text() string {
+	if r.Stream != streamAgent {
+		return r.Message
+	}
+
+	var b strings.Builder
+	b.WriteString("[agent:" + r.Source + "] " + strings.ToUpper(r.Level) + " " + r.Message)
+
+	keys := make([]string, 0, len(r.Attrs))
+	for key := range r.Attrs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value := fmt.Sprint(r.Attrs[key])
+		if value == "" || strings.ContainsAny(value, " \t\"=") {
+			value = strconv.Quote(value)
+		}
+		b.WriteString(" " + key + "=" + value)
+	}
+
+	return b.String()
+}
+
+// logRouter numbers and timestamps the lines of all streams and hands them
+// to the sinks: text lines to local, records to remote.
+type logRouter struct {
+	mu      sync.Mutex
+	seq     uint64
+	started time.Time
+	local   io.Writer
+	remote  *RemoteLogger
+}
+
+func newLogRouter(local io.Writer, remote *RemoteLogger) *logRouter {
+	r := &logRouter{started: time.Now(), local: local, remote: remote}
+	if remote != nil {
+		remote.number = r.number
+	}
+	return r
+}
+
+// number gives record the next sequence number and the current time.
+func (r *logRouter) number(record *logRecord) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.numberLocked(record)
+}
+
+func (r *logRouter) numberLocked(record *logRecord) {
+	r.seq++
+	record.Seq = r.seq
+	// Derived from the monotonic clock, so timestamps never go backwards
+	// even when the wall clock is adjusted.
+	record.Time = r.started.Add(time.Since(r.started))
+}
+
+func (r *logRouter) emit(record logRecord) {
+	r.mu.Lock()
+	r.numberLocked(&record)
+
+	io.WriteString(r.local, record.text()+"\n")
+	r.mu.Unlock()
+
+	// Under the block overflow policy the remote write can wait for the
+	// spool to drain. Only the writer of this record waits then, while the
+	// other streams keep reaching the local log. Concurrent records may thus
+	// reach the spool slightly out of order; their sequence numbers tell.
+	if r.remote != nil {
+		r.remote.WriteRecord(record)
+	}
+}
+
+// emitLocal writes record to the local log only. It takes no sequence
+// number, so the numbering of the remote log has no gaps.
+func (r *logRouter) emitLocal(record logRecord) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	record.Time = r.started.Add(time.Since(r.started))
+	io.WriteString(r.local, record.text()+"\n")
+}
+
+// lineWriter frames the bytes written to a stream into lines. Child output
+// may arrive in arbitrary pieces, so partial lines are held back until their
+// newline arrives.
+type lineWriter struct {
+	router *logRouter
+	stream logStream
+	source string
+	level  slog.Level
+
+	mu       sync.Mutex
+	partial  []byte
+	timer    *time.Timer
+	timerGen uint64
+}
+
+// jobWriter returns the writer of an output stream of the job command.
+func (r *logRouter) jobWriter(stream logStream) *lineWriter {
+	return &lineWriter{router: r, stream: stream, source: sourceJob}
+}
+
+// agentWriter returns the writer of the output of a process an agent
+// subsystem runs, e.g. the ssh client of a tunnel. Its lines are logged as
+// messages of that subsystem at level, subject to agent_log_level.
+func (r *logRouter) agentWriter(source string, level slog.Level) *lineWriter {
+	return &lineWriter{router: r, stream: streamAgent, source: source, level: level}
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	data := p
+	for len(data) > 0 {
+		newline := bytes.IndexByte(data, '\n')
+		if newline < 0 {
+			w.partial = append(w.partial, data...)
+			break
+		}
+
+		line := data[:newline]
+		if len(w.partial) > 0 {
+			line = append(w.partial, line...)
+			w.partial = nil
+			w.stopTimer()
+		}
+		w.emit(bytes.TrimSuffix(line, []byte("\r")))
+
+		data = data[newline+1:]
+	}
+
+	for len(w.partial) > maxLogLineBytes {
+		w.emit(w.partial[:maxLogLineBytes])
+		w.partial = append([]byte(nil), w.partial[maxLogLineBytes:]...)
+	}
+
+	// The timeout runs from the start of the pending partial line, so a
+	// line completed in time is never cut.
+	if len(w.partial) > 0 && w.timer == nil {
+		w.timerGen++
+		gen := w.timerGen
+		w.timer = time.AfterFunc(partialLineTimeout, func() { w.flushTimer(gen) })
+	}
+
+	return len(p), nil
+}
+
+// flushTimer flushes the partial line that timer gen was armed for. A timer
+// stopped too late to keep it from firing finds a newer generation and
+// leaves the current partial line alone.
+func (w *lineWriter) flushTimer(gen uint64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if gen == w.timerGen {
+		w.flushLocked()
+	}
+}
+
+func (w *lineWriter) stopTimer() {
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+}
+
+// emit splits line into records of at most maxLogLineBytes.
+func (w *lineWriter) emit(line []byte) {
+	for len(line) > maxLogLineBytes {
+		w.emitRecord(line[:maxLogLineBytes])
+		line = line[maxLogLineBytes:]
+	}
+	w.emitRecord(line)
+}
+
+func (w *lineWriter) emitRecord(line []byte) {
+	record := logRecord{
+		Stream:  w.stream,
+		Source:  w.source,
+		Message: string(line),
+	}
+
+	if w.stream == streamAgent {
+		if w.level < agentLogLevel.Level() {
+			return
+		}
+		record.Level = slogLevel(w.level)
+	}
+
+	w.router.emit(record)
+}
+
+// Flush emits a pending partial line.
+func (w *lineWriter) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.flushLocked()
+}
+
+func (w *lineWriter) flushLocked() {
+	w.stopTimer()
+
+	if len(w.partial) > 0 {
+		w.emit(w.partial)
+		w.partial = nil
+	}
+}
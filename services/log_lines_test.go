@@ -0,0 +1,135 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recordedLines returns the local log written so far, one line per record.
+func recordedLines(r *logRouter, local *bytes.Buffer) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return strings.Split(strings.TrimSuffix(local.String(), "\n"), "\n")
+}
+
+func TestLineWriterFraming(t *testing.T) {
+	tests := []struct {
+		name   string
+		writes []string
+		want   []string
+	}{
+		{"whole lines", []string{"a\nb\n"}, []string{"a", "b"}},
+		{"split line", []string{"he", "llo", "\n"}, []string{"hello"}},
+		{"newline first", []string{"a", "\nb\n"}, []string{"a", "b"}},
+		{"carriage return", []string{"a\r\n"}, []string{"a"}},
+		{"empty line", []string{"\n"}, []string{""}},
+		{"long line", []string{strings.Repeat("x", maxLogLineBytes+1) + "\n"},
+			[]string{strings.Repeat("x", maxLogLineBytes), "x"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var local bytes.Buffer
+			router := newLogRouter(&local, nil)
+			w := router.jobWriter(streamStdout)
+
+			for _, p := range tt.writes {
+				w.Write([]byte(p))
+			}
+			w.Flush()
+
+			got := recordedLines(router, &local)
+			if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLineWriterPartialLineTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { partialLineTimeout = timeout }(partialLineTimeout)
+	partialLineTimeout = 200 * time.Millisecond
+
+	var local bytes.Buffer
+	router := newLogRouter(&local, nil)
+	w := router.jobWriter(streamStdout)
+
+	// The timer armed for "a" must not cut the later line.
+	w.Write([]byte("a"))
+	w.Write([]byte("\n"))
+	time.Sleep(150 * time.Millisecond)
+	w.Write([]byte("hello "))
+	time.Sleep(100 * time.Millisecond)
+	w.Write([]byte("world\n"))
+
+	// An unterminated line is emitted once the timeout has passed.
+	w.Write([]byte("50%"))
+	time.Sleep(400 * time.Millisecond)
+
+	got := recordedLines(router, &local)
+	want := []string{"a", "hello world", "50%"}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestOmittedMarkerIsNumbered(t *testing.T) {
+	spool, err := newLogSpool(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	remote := &RemoteLogger{
+		spool: spool,
+		config: LogSinkConfig{
+			FlushBytes:     1 << 20,
+			MaxBytes:       200,
+			OverflowPolicy: LogOverflowDropNewest,
+			Format:         LogFormatText,
+		},
+		ctx:      context.Background(),
+		flushNow: make(chan struct{}, 1),
+		freed:    make(chan struct{}, 1),
+	}
+
+	var local bytes.Buffer
+	router := newLogRouter(&local, remote)
+	w := router.jobWriter(streamStdout)
+
+	w.Write([]byte(strings.Repeat("x", 100) + "\n"))
+	w.Write([]byte(strings.Repeat("y", 100) + "\n"))
+
+	// Uploading the first line makes room again.
+	spool.seal()
+	for _, seq := range spool.pending() {
+		spool.ack(seq)
+	}
+	w.Write([]byte("kept\n"))
+	spool.seal()
+
+	var sent strings.Builder
+	for _, seq := range spool.pending() {
+		data, err := spool.read(seq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sent.Write(data)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(sent.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %q, want the marker and one line", lines)
+	}
+
+	marker := strings.Fields(lines[0])
+	if len(marker) < 4 || marker[1] != "4" || marker[2] != "[agent:agent]" || marker[3] != "WARN" {
+		t.Errorf("marker = %q, want a timestamp, seq 4 and the agent stream", lines[0])
+	}
+	if !strings.HasSuffix(lines[1], " 3 [stdout] kept") {
+		t.Errorf("line = %q, want seq 3 on stdout", lines[1])
+	}
+}
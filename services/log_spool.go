@@ -0,0 +1,220 @@
+package services
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	defaultLogSpoolDir = "/mnt/agent/log-spool"
+
+	// A segment is sealed once it reaches maxLogSegmentBytes, so a single
+	// log batch upload stays small.
+	maxLogSegmentBytes = 4 * 1024 * 1024
+
+	logSegmentExt = ".seg"
+)
+
+// logSpool is the write-ahead spool of the remote log sink. Every chunk
+// written to the log is appended to the active segment file; the flusher
+// seals it and uploads sealed segments in order, deleting each once the
+// accelerator has it. A segment that fails to upload stays on disk and is
+// retried on the next flush, and segments a killed container left behind are
+// uploaded by the next run.
+//
+// Segments are named <seq>.seg. The sequence number also names the uploaded
+// log batch, wkube<seq>.log, and keeps counting across container restarts.
+type logSpool struct {
+	dir string
+
+	mu          sync.Mutex
+	active      *os.File
+	activeSeq   int
+	activeBytes int64
+	nextSeq     int
+	sealed      []int
+
+	// uploading is the segment the flusher is sending, -1 when none.
+	// dropOldest leaves it alone, since its bytes are about to be delivered.
+	uploading int
+
+	// sizes holds the size of every segment on disk, totalBytes their sum.
+	sizes      map[int]int64
+	totalBytes int64
+}
+
+// newLogSpool opens the spool in dir, picking up the segments a previous run
+// did not upload.
+func newLogSpool(dir string) (*logSpool, error) {
+	if err := os.MkdirAll(dir, 0775); err != nil {
+		return nil, fmt.Errorf("error creating log spool directory: %v", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading log spool directory: %v", err)
+	}
+
+	s := &logSpool{dir: dir, sizes: make(map[int]int64), uploading: -1}
+
+	for _, entry := range entries {
+		seq, err := strconv.Atoi(strings.TrimSuffix(entry.Name(), logSegmentExt))
+		if err != nil || !strings.HasSuffix(entry.Name(), logSegmentExt) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		s.sealed = append(s.sealed, seq)
+		s.nextSeq = max(s.nextSeq, seq+1)
+		s.sizes[seq] = info.Size()
+		s.totalBytes += info.Size()
+	}
+
+	sort.Ints(s.sealed)
+
+	return s, nil
+}
+
+func (s *logSpool) segmentPath(seq int) string {
+	return filepath.Join(s.dir, strconv.Itoa(seq)+logSegmentExt)
+}
+
+// append writes p to the active segment, starting a new one if needed.
+func (s *logSpool) append(p []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.active == nil {
+		f, err := os.OpenFile(s.segmentPath(s.nextSeq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		s.active = f
+		s.activeSeq = s.nextSeq
+		s.activeBytes = 0
+		s.nextSeq++
+	}
+
+	n, err := s.active.Write(p)
+	s.activeBytes += int64(n)
+	s.sizes[s.activeSeq] += int64(n)
+	s.totalBytes += int64(n)
+
+	if s.activeBytes >= maxLogSegmentBytes {
+		s.sealLocked()
+	}
+
+	return err
+}
+
+// seal closes the active segment, making it ready for upload.
+func (s *logSpool) seal() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sealLocked()
+}
+
+func (s *logSpool) sealLocked() {
+	if s.active == nil {
+		return
+	}
+
+	s.active.Close()
+	s.active = nil
+	s.sealed = append(s.sealed, s.activeSeq)
+}
+
+// size returns the bytes spooled and not yet uploaded.
+func (s *logSpool) size() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.totalBytes
+}
+
+// pending returns the sealed segments in upload order.
+func (s *logSpool) pending() []int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]int(nil), s.sealed...)
+}
+
+func (s *logSpool) read(seq int) ([]byte, error) {
+	return os.ReadFile(s.segmentPath(seq))
+}
+
+// setUploading marks seq as the segment being uploaded, -1 for none.
+func (s *logSpool) setUploading(seq int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.uploading = seq
+}
+
+// ack deletes an uploaded segment.
+func (s *logSpool) ack(seq int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.removeLocked(seq)
+}
+
+// dropOldest deletes the oldest segment without uploading it, sealing the
+// active one first when it is the only one left. The segment being uploaded
+// is skipped. It returns the bytes dropped, 0 when there is nothing to drop.
+func (s *logSpool) dropOldest() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	seq, ok := s.oldestDroppableLocked()
+	if !ok {
+		s.sealLocked()
+		seq, ok = s.oldestDroppableLocked()
+	}
+	if !ok {
+		return 0
+	}
+
+	size := s.sizes[seq]
+	if err := s.removeLocked(seq); err != nil {
+		return 0
+	}
+
+	return size
+}
+
+func (s *logSpool) oldestDroppableLocked() (int, bool) {
+	for _, seq := range s.sealed {
+		if seq != s.uploading {
+			return seq, true
+		}
+	}
+	return 0, false
+}
+
+func (s *logSpool) removeLocked(seq int) error {
+	for i, sealed := range s.sealed {
+		if sealed == seq {
+			s.sealed = append(s.sealed[:i], s.sealed[i+1:]...)
+			break
+		}
+	}
+
+	if err := os.Remove(s.segmentPath(seq)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	s.totalBytes -= s.sizes[seq]
+	delete(s.sizes, seq)
+
+	return nil
+}
@@ -0,0 +1,35 @@
+package services
+
+import "testing"
+
+func TestLogSpoolDropOldestSkipsUpload(t *testing.T) {
+	spool, err := newLogSpool(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, line := range []string{"first\n", "second\n"} {
+		if err := spool.append([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+		spool.seal()
+	}
+
+	pending := spool.pending()
+	spool.setUploading(pending[0])
+
+	if dropped := spool.dropOldest(); dropped != int64(len("second\n")) {
+		t.Errorf("dropped %d bytes, want the segment after the one being uploaded", dropped)
+	}
+	if dropped := spool.dropOldest(); dropped != 0 {
+		t.Errorf("dropped %d bytes of the segment being uploaded", dropped)
+	}
+	if data, err := spool.read(pending[0]); err != nil || string(data) != "first\n" {
+		t.Errorf("got %q, %v, want the segment being uploaded kept", data, err)
+	}
+
+	spool.setUploading(-1)
+	if dropped := spool.dropOldest(); dropped != int64(len("first\n")) {
+		t.Errorf("dropped %d bytes, want the oldest segment once uploaded", dropped)
+	}
+}
@@ -1,37 +1,148 @@
 package services
 
 import (
-	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"os"
+	"strconv"
 	"sync"
 	"time"
 )
 
-var (
-	logCounter int
-	counterMu  sync.Mutex
+const (
+	defaultLogFlushInterval  = 2 * time.Second
+	defaultLogFlushBytes     = 1024 * 1024
+	defaultLogBufferMaxBytes = 256 * 1024 * 1024
+
+	// Without logs to send, the job's health is checked at this interval.
+	logHealthCheckInterval = 10 * time.Second
+
+	// A writer blocked by the block policy gives up after maxLogBlock and
+	// drops its write, so a long gateway outage cannot hang the job forever.
+	maxLogBlock = 30 * time.Second
+
+	// FinalFlush retries segments that fail to upload this many times before
+	// leaving them to the next run.
+	finalFlushAttempts   = 3
+	finalFlushRetryDelay = 2 * time.Second
+)
+
+// Formats of the logs sent to the accelerator: timestamped text lines, or
+// one JSON record per line (NDJSON).
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
 )
 
+// Policies for writes that do not fit the log buffer.
 const (
-	logChannelSize   = 1000
-	logFlushInterval = 10 * time.Second
+	LogOverflowDropNewest = "drop-newest"
+	LogOverflowDropOldest = "drop-oldest"
+	LogOverflowBlock      = "block"
+)
+
+const logTimeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+// The sink reports its own problems to the local log only. Written to the
+// spool they could block the flusher, the one goroutine that frees it.
+var (
+	sinkLog       = newLocalAgentLogger(sourceAgent)
+	sinkHealthLog = newLocalAgentLogger(sourceHealth)
 )
 
-var omittedMsgPrefix = "\n[Logs omitted: %d messages dropped due to full channel]\n"
+var omittedMsg = "[Logs omitted: %d bytes dropped due to full log buffer]"
 
+// LogSinkConfig controls when log batches are sent and what happens when
+// the log buffer is full.
+type LogSinkConfig struct {
+	// Logs are sent every FlushInterval, and as soon as FlushBytes have
+	// accumulated.
+	FlushInterval time.Duration
+	FlushBytes    int64
+
+	// MaxBytes bounds the logs buffered in the spool, OverflowPolicy says
+	// what happens to writes beyond it.
+	MaxBytes       int64
+	OverflowPolicy string
+
+	// Format is LogFormatText or LogFormatJSON.
+	Format string
+}
+
+// logSinkConfigFromEnv reads log_flush_interval, log_flush_bytes,
+// log_buffer_max_bytes, log_overflow_policy and log_format. Invalid values are replaced
+// by their defaults and reported in the returned error.
+func logSinkConfigFromEnv() (LogSinkConfig, error) {
+	config := LogSinkConfig{
+		FlushInterval:  defaultLogFlushInterval,
+		FlushBytes:     max(int64(getenvInt("log_flush_bytes", defaultLogFlushBytes)), 1),
+		MaxBytes:       max(int64(getenvInt("log_buffer_max_bytes", defaultLogBufferMaxBytes)), 1),
+		OverflowPolicy: getenvWithDefault("log_overflow_policy", LogOverflowDropNewest),
+		Format:         getenvWithDefault("log_format", LogFormatText),
+	}
+
+	var errs []error
+
+	if value := os.Getenv("log_flush_interval"); value != "" {
+		interval, err := time.ParseDuration(value)
+		if err != nil || interval <= 0 {
+			errs = append(errs, fmt.Errorf("invalid log_flush_interval %q, using %s", value, defaultLogFlushInterval))
+		} else {
+			config.FlushInterval = interval
+		}
+	}
+
+	switch config.OverflowPolicy {
+	case LogOverflowDropNewest, LogOverflowDropOldest, LogOverflowBlock:
+	default:
+		errs = append(errs, fmt.Errorf("invalid log_overflow_policy %q, using %s", config.OverflowPolicy, LogOverflowDropNewest))
+		config.OverflowPolicy = LogOverflowDropNewest
+	}
+
+	if config.Format != LogFormatText && config.Format != LogFormatJSON {
+		errs = append(errs, fmt.Errorf("invalid log_format %q, using %s", config.Format, LogFormatText))
+		config.Format = LogFormatText
+	}
+
+	return config, errors.Join(errs...)
+}
+
+// RemoteLogger sends the job log to the accelerator in batches. Writes go to
+// an on-disk spool first, so lines are not lost while the gateway is
+// unreachable. The spool is bounded by bytes; writes that do not fit are
+// handled by the overflow policy.
 type RemoteLogger struct {
-	logChan     chan []byte
-	ctx         context.Context
-	droppedLogs int
-	mu          sync.Mutex
-	wg          sync.WaitGroup
+	spool        *logSpool
+	config       LogSinkConfig
+	ctx          context.Context
+	droppedBytes int64
+	mu           sync.Mutex
+	flushMu      sync.Mutex
+	wg           sync.WaitGroup
+
+	// flushNow asks for a flush before the next tick, freed reports that
+	// uploaded segments made room in the spool.
+	flushNow chan struct{}
+	freed    chan struct{}
+
+	// lastContact is when the accelerator last answered a batch or health
+	// check, guarded by flushMu.
+	lastContact time.Time
+
+	// number gives the lines the sink writes itself a sequence number and
+	// timestamp of the job log. Set by the log router.
+	number func(*logRecord)
 }
 
-func NewRemoteLogger(ctx context.Context, cancel context.CancelFunc) *RemoteLogger {
+func NewRemoteLogger(ctx context.Context, cancel context.CancelFunc, spool *logSpool, config LogSinkConfig) *RemoteLogger {
 	rl := &RemoteLogger{
-		logChan: make(chan []byte, logChannelSize),
-		ctx:     ctx,
+		spool:    spool,
+		config:   config,
+		ctx:      ctx,
+		flushNow: make(chan struct{}, 1),
+		freed:    make(chan struct{}, 1),
 	}
 
 	rl.wg.Add(1)
@@ -40,81 +151,236 @@ func NewRemoteLogger(ctx context.Context, cancel context.CancelFunc) *RemoteLogg
 	return rl
 }
 
+// WriteRecord spools a line of the job log in the configured format.
+func (rl *RemoteLogger) WriteRecord(record logRecord) {
+	rl.Write(rl.encode(record))
+}
+
+// encode renders a record as a JSON line, or as a text line prefixed with
+// its timestamp, sequence number and stream. Agent messages carry their
+// component and level like in the local log.
+func (rl *RemoteLogger) encode(record logRecord) []byte {
+	record.Time = record.Time.UTC()
+
+	if rl.config.Format == LogFormatJSON {
+		line, err := json.Marshal(record)
+		if err != nil {
+			// E.g. a NaN float attr. The line stays JSON with the attrs
+			// that cannot be encoded given as text.
+			record.Attrs = stringifyAttrs(record.Attrs)
+			line, err = json.Marshal(record)
+		}
+		if err != nil {
+			record.Attrs = nil
+			line, _ = json.Marshal(record)
+		}
+		return append(line, '\n')
+	}
+
+	line := record.Time.Format(logTimeFormat) + " " + strconv.FormatUint(record.Seq, 10) + " "
+	if record.Stream != streamAgent {
+		line += "[" + string(record.Stream) + "] "
+	}
+
+	return []byte(line + record.text() + "\n")
+}
+
+// stringifyAttrs returns attrs with the values JSON cannot encode replaced by
+// their text form.
+func stringifyAttrs(attrs map[string]any) map[string]any {
+	out := make(map[string]any, len(attrs))
+	for key, value := range attrs {
+		if _, err := json.Marshal(value); err != nil {
+			value = fmt.Sprint(value)
+		}
+		out[key] = value
+	}
+	return out
+}
+
+// omittedMarker is the line that stands in for dropped output. It is a line
+// of the job log like any other, numbered after the lines written so far.
+func (rl *RemoteLogger) omittedMarker(dropped int64) []byte {
+	record := logRecord{
+		Time:    time.Now(),
+		Stream:  streamAgent,
+		Level:   levelWarn,
+		Source:  sourceAgent,
+		Message: fmt.Sprintf(omittedMsg, dropped),
+	}
+	if rl.number != nil {
+		rl.number(&record)
+	}
+
+	return rl.encode(record)
+}
+
+// Write spools p as is.
 func (rl *RemoteLogger) Write(p []byte) (int, error) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if !rl.makeRoom(int64(len(p))) {
+		rl.droppedBytes += int64(len(p))
+		return len(p), nil
+	}
+
+	// Dropped logs are accounted for as soon as the spool takes data again.
+	if rl.droppedBytes > 0 {
+		if err := rl.spool.append(rl.omittedMarker(rl.droppedBytes)); err == nil {
+			rl.droppedBytes = 0
+		}
+	}
+
+	if err := rl.spool.append(p); err != nil {
+		// E.g. a full disk.
+		rl.droppedBytes += int64(len(p))
+	}
+
+	if rl.spool.size() >= rl.config.FlushBytes {
+		signal(rl.flushNow)
+	}
+
+	return len(p), nil
+}
+
+// makeRoom applies the overflow policy until n more bytes fit in the spool.
+// It reports false when the write has to be dropped. Called with rl.mu held.
+func (rl *RemoteLogger) makeRoom(n int64) bool {
+	var deadline <-chan time.Time
+
+	for rl.spool.size()+n > rl.config.MaxBytes {
+		switch rl.config.OverflowPolicy {
+		case LogOverflowDropOldest:
+			dropped := rl.spool.dropOldest()
+			if dropped == 0 {
+				// The write alone is larger than the buffer, or only the
+				// segment being uploaded is left.
+				return rl.spool.size() == 0
+			}
+			rl.droppedBytes += dropped
+		case LogOverflowBlock:
+			if rl.ctx.Err() != nil {
+				return false
+			}
+			if deadline == nil {
+				deadline = time.After(maxLogBlock)
+			}
+
+			signal(rl.flushNow)
+
+			// Other writers queue up behind rl.mu, so the job's output is
+			// held back as a whole.
+			rl.mu.Unlock()
+			select {
+			case <-rl.freed:
+			case <-deadline:
+				rl.mu.Lock()
+				return false
+			case <-rl.ctx.Done():
+			}
+			rl.mu.Lock()
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// signal wakes up the receiver of ch without blocking.
+func signal(ch chan struct{}) {
 	select {
-	case rl.logChan <- append([]byte(nil), p...):
+	case ch <- struct{}{}:
 	default:
-		rl.mu.Lock()
-		rl.droppedLogs++
-		rl.mu.Unlock()
 	}
-	return len(p), nil
 }
 
 func (rl *RemoteLogger) run(cancel context.CancelFunc) {
-	tick := time.NewTicker(logFlushInterval)
+	tick := time.NewTicker(rl.config.FlushInterval)
 	defer tick.Stop()
 	defer rl.wg.Done()
 
+	// Early flushes are skipped while the accelerator is failing, so a full
+	// buffer does not hammer it between ticks.
+	failing := false
+
 	for {
 		select {
 		case <-tick.C:
-			rl.flushFromChannel(cancel)
+			failing = !rl.flush(cancel)
+		case <-rl.flushNow:
+			if !failing {
+				failing = !rl.flush(cancel)
+			}
 		case <-rl.ctx.Done():
-			rl.flushFromChannel(cancel)
+			rl.flush(cancel)
 			return
 		}
 	}
 }
 
-func (rl *RemoteLogger) flushFromChannel(cancel context.CancelFunc) {
-	var batch [][]byte
+// flush seals the active segment and uploads every sealed segment in order.
+// It stops at the first failure, leaving that segment and the ones after it
+// for the next flush. It reports whether the spool was fully drained.
+func (rl *RemoteLogger) flush(cancel context.CancelFunc) bool {
+	rl.flushMu.Lock()
+	defer rl.flushMu.Unlock()
 
-DrainLoop:
-	for {
-		select {
-		case log := <-rl.logChan:
-			batch = append(batch, log)
-		default:
-			break DrainLoop
+	rl.spool.seal()
+
+	pending := rl.spool.pending()
+
+	if len(pending) == 0 {
+		// Sent batches report the job's health too.
+		if time.Since(rl.lastContact) >= logHealthCheckInterval {
+			if err := CheckHealth(cancel); err != nil {
+				sinkHealthLog.Error("Error in health check", "err", err)
+			} else {
+				rl.lastContact = time.Now()
+			}
 		}
+		return true
 	}
 
-	dropped := rl.getAndResetDroppedCount()
-
-	if len(batch) == 0 && dropped == 0 {
-		if err := CheckHealth(cancel); err != nil {
-			fmt.Fprintf(MultiLogWriter, "error in health check function: %v\n", err)
+	for _, seq := range pending {
+		if err := rl.sendSegment(seq, cancel); err != nil {
+			sinkLog.Warn("Failed to send logs to remote sink, will retry", "err", err)
+			return false
 		}
-		return
 	}
 
-	var buf bytes.Buffer
+	return true
+}
 
-	if dropped > 0 {
-		buf.WriteString(fmt.Sprintf(omittedMsgPrefix, dropped))
-	}
+func (rl *RemoteLogger) sendSegment(seq int, cancel context.CancelFunc) error {
+	// Kept from the drop-oldest policy until acknowledged, so delivered
+	// logs are never reported as omitted.
+	rl.spool.setUploading(seq)
+	defer rl.spool.setUploading(-1)
 
-	for _, log := range batch {
-		buf.Write(log)
+	data, err := rl.spool.read(seq)
+	if os.IsNotExist(err) {
+		return rl.spool.ack(seq)
+	}
+	if err != nil {
+		return fmt.Errorf("error reading log segment %d: %v", seq, err)
 	}
 
-	counterMu.Lock()
-	logFilename := fmt.Sprintf("wkube%d", logCounter)
-	logCounter++
-	counterMu.Unlock()
+	if len(data) > 0 {
+		if err := SendBatch(data, fmt.Sprintf("wkube%d", seq), cancel); err != nil {
+			return err
+		}
+		rl.lastContact = time.Now()
+	}
 
-	if err := SendBatch(buf.Bytes(), logFilename, cancel); err != nil {
-		fmt.Fprintf(MultiLogWriter, "Failed to send logs to remote sink: %v\n", err)
+	if err := rl.spool.ack(seq); err != nil {
+		sinkLog.Warn("Error removing uploaded log segment", "segment", seq, "err", err)
 	}
-}
 
-func (rl *RemoteLogger) getAndResetDroppedCount() int {
-	rl.mu.Lock()
-	defer rl.mu.Unlock()
-	dropped := rl.droppedLogs
-	rl.droppedLogs = 0
-	return dropped
+	signal(rl.freed)
+
+	return nil
 }
 
 // Optional: for use in tests or shutdown sync
@@ -122,6 +388,10 @@ func (rl *RemoteLogger) Wait() {
 	rl.wg.Wait()
 }
 
+// FinalFlush drains the spool, retrying failed uploads a few times. Segments
+// that still fail stay on disk for the next run of the container.
 func (rl *RemoteLogger) FinalFlush() {
-	rl.flushFromChannel(nil)
+	for attempt := 1; !rl.flush(nil) && attempt < finalFlushAttempts; attempt++ {
+		time.Sleep(finalFlushRetryDelay)
+	}
 }
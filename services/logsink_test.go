@@ -0,0 +1,33 @@
+package services
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestEncodeJSONUnencodableAttrs(t *testing.T) {
+	rl := &RemoteLogger{config: LogSinkConfig{Format: LogFormatJSON}}
+
+	line := rl.encode(logRecord{
+		Seq:     7,
+		Time:    time.Now(),
+		Stream:  streamAgent,
+		Level:   levelInfo,
+		Source:  sourceAgent,
+		Message: "ratio",
+		Attrs:   map[string]any{"ratio": math.NaN(), "file": "a.csv"},
+	})
+
+	var decoded struct {
+		Seq   uint64         `json:"seq"`
+		Attrs map[string]any `json:"attrs"`
+	}
+	if err := json.Unmarshal(line, &decoded); err != nil {
+		t.Fatalf("%q is not JSON: %v", line, err)
+	}
+	if decoded.Seq != 7 || decoded.Attrs["ratio"] != "NaN" || decoded.Attrs["file"] != "a.csv" {
+		t.Errorf("got %q, want the NaN as text and the other attrs as they are", line)
+	}
+}
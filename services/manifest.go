@@ -0,0 +1,130 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const manifestLocalPath = "/tmp/manifest.json"
+
+// manifestEntry describes one output file of the job.
+type manifestEntry struct {
+	LocalPath  string `json:"local_path"`
+	RemotePath string `json:"remote_path"`
+	Mapping    string `json:"mapping"`
+
+	// Status is "uploaded", or "unchanged" for a file a sync-mode mapping
+	// left alone because its remote copy was already up to date.
+	Status string `json:"status"`
+
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256,omitempty"`
+	MD5    string `json:"md5,omitempty"`
+
+	// ContentEncoding is set for files uploaded compressed, in which case
+	// Size and the checksums are of the compressed object.
+	ContentEncoding string `json:"content_encoding,omitempty"`
+
+	// ObjectName is the name the file was stored under, which can differ from
+	// RemotePath when the accelerator made it unique.
+	BucketObjectID int    `json:"bucket_object_id,omitempty"`
+	ObjectName     string `json:"object_name,omitempty"`
+
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+// outputManifest collects the output files of the job, uploaded by output
+// checkpoints as well as by the final output mapping, and is uploaded as
+// manifest.json once the output mappings are processed.
+type outputManifest struct {
+	mu    sync.Mutex
+	files map[string]manifestEntry
+}
+
+type manifestDocument struct {
+	PodID       string          `json:"pod_id"`
+	Complete    bool            `json:"complete"`
+	GeneratedAt time.Time       `json:"generated_at"`
+	Files       []manifestEntry `json:"files"`
+}
+
+var jobManifest = &outputManifest{files: make(map[string]manifestEntry)}
+
+// add records an output file. A later entry for the same remote path, e.g.
+// the final upload of a file a checkpoint uploaded before, replaces the
+// earlier one.
+func (m *outputManifest) add(entry manifestEntry) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.files[entry.RemotePath] = entry
+}
+
+func (m *outputManifest) addUpload(mapping Mapping, localPath, destPath string, result *uploadResult, started time.Time) {
+	finished := time.Now()
+
+	m.add(manifestEntry{
+		LocalPath:       localPath,
+		RemotePath:      destPath,
+		Mapping:         mapping.String(),
+		Status:          "uploaded",
+		Size:            result.Size,
+		SHA256:          result.Checksums.SHA256,
+		MD5:             result.Checksums.MD5,
+		ContentEncoding: result.ContentEncoding,
+		BucketObjectID:  result.BucketObjectID,
+		ObjectName:      result.ObjectName,
+		StartedAt:       &started,
+		FinishedAt:      &finished,
+	})
+}
+
+// write saves the manifest to path, with files sorted by remote path.
+// complete is false when the output mappings failed, in which case the
+// manifest only lists what made it.
+func (m *outputManifest) write(path string, complete bool) error {
+	m.mu.Lock()
+	doc := manifestDocument{
+		PodID:       getenvWithDefault("POD_ID", "unknown"),
+		Complete:    complete,
+		GeneratedAt: time.Now(),
+		Files:       make([]manifestEntry, 0, len(m.files)),
+	}
+	for _, entry := range m.files {
+		doc.Files = append(doc.Files, entry)
+	}
+	m.mu.Unlock()
+
+	sort.Slice(doc.Files, func(i, j int) bool {
+		return doc.Files[i].RemotePath < doc.Files[j].RemotePath
+	})
+
+	data, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// uploadOutputManifest writes the manifest and uploads it to the job output
+// folder as output_manifest, "manifest.json" by default.
+func uploadOutputManifest(complete bool) error {
+	if err := jobManifest.write(manifestLocalPath, complete); err != nil {
+		return fmt.Errorf("error writing output manifest: %v", err)
+	}
+
+	remotePath := getenvWithDefault("output_manifest", "manifest.json")
+
+	if err := UploadFile(context.Background(), manifestLocalPath, remotePath); err != nil {
+		return fmt.Errorf("error uploading output manifest: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,363 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const accPrefix = "acc://"
+
+type MappingKind string
+
+const (
+	MappingKindAccelerator     MappingKind = "acc"
+	MappingKindPipe            MappingKind = "pipe"
+	MappingKindGraph           MappingKind = "graph"
+	MappingKindSelectedFiles   MappingKind = "selected_files"
+	MappingKindSelectedFolders MappingKind = "selected_folders"
+)
+
+// MappingOptions holds per-mapping settings that have no place in the legacy
+// semicolon-delimited syntax.
+type MappingOptions struct {
+	// Optional skips the mapping with a warning instead of failing the job
+	// when the local or mounted source does not exist.
+	Optional bool `json:"optional,omitempty" yaml:"optional,omitempty"`
+
+	// Include and Exclude select files by their path relative to the
+	// mapping source. See pathPattern for the pattern syntax.
+	Include []string `json:"include,omitempty" yaml:"include,omitempty"`
+	Exclude []string `json:"exclude,omitempty" yaml:"exclude,omitempty"`
+
+	// Sync makes an acc:// output mapping skip files whose remote copy has
+	// the same size and checksum.
+	Sync bool `json:"sync,omitempty" yaml:"sync,omitempty"`
+
+	// Archive is an ArchiveFormat. An acc:// output mapping uploads its
+	// source as a single archive; an acc:// input mapping extracts the
+	// archives it downloads into the destination directory.
+	Archive string `json:"archive,omitempty" yaml:"archive,omitempty"`
+
+	// Compress is the content encoding, gzip or zstd, acc:// output files
+	// are uploaded with. The stored objects keep their names and are
+	// decompressed again when downloaded by an input mapping.
+	Compress string `json:"compress,omitempty" yaml:"compress,omitempty"`
+}
+
+// Mapping is a single input or output mapping. For input mappings Kind
+// describes the source, for output mappings it describes the destination.
+// Accelerator paths are stored without the acc:// prefix once normalized.
+type Mapping struct {
+	Source      string         `json:"source" yaml:"source"`
+	Destination string         `json:"destination,omitempty" yaml:"destination,omitempty"`
+	Kind        MappingKind    `json:"kind,omitempty" yaml:"kind,omitempty"`
+	Options     MappingOptions `json:"options,omitempty" yaml:"options,omitempty"`
+
+	// raw is the mapping as the user wrote it, kept for error messages.
+	raw string
+
+	// filter is compiled from the include and exclude options.
+	filter *pathFilter
+}
+
+func (m Mapping) String() string {
+	if m.raw != "" {
+		return m.raw
+	}
+	return fmt.Sprintf("%s:%s", m.Source, m.Destination)
+}
+
+// MappingSpec is the structured mapping document accepted through the
+// mappings file.
+type MappingSpec struct {
+	Inputs  []Mapping `json:"inputs" yaml:"inputs"`
+	Outputs []Mapping `json:"outputs" yaml:"outputs"`
+}
+
+// MappingsFile is the path of the structured mapping document. When empty the
+// legacy input_mappings/output_mappings environment variables are used.
+var MappingsFile = os.Getenv("mappings_file")
+
+// LoadMappingSpec reads the mapping document, or the legacy environment
+// variables as a fallback, and returns the normalized mappings.
+func LoadMappingSpec() (*MappingSpec, error) {
+	var spec *MappingSpec
+	var err error
+
+	if MappingsFile != "" {
+		spec, err = readMappingsFile(MappingsFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading mappings file %s: %v", MappingsFile, err)
+		}
+	} else {
+		spec = &MappingSpec{}
+
+		spec.Inputs, err = parseLegacyMappings(os.ExpandEnv(os.Getenv("input_mappings")))
+		if err != nil {
+			return nil, fmt.Errorf("error: invalid input mapping syntax: %w", err)
+		}
+
+		spec.Outputs, err = parseLegacyMappings(os.ExpandEnv(os.Getenv("output_mappings")))
+		if err != nil {
+			return nil, fmt.Errorf("error: invalid output mapping syntax: %w", err)
+		}
+	}
+
+	for i, mapping := range spec.Inputs {
+		if spec.Inputs[i], err = normalizeInputMapping(mapping); err != nil {
+			return nil, err
+		}
+	}
+
+	for i, mapping := range spec.Outputs {
+		if spec.Outputs[i], err = normalizeOutputMapping(mapping); err != nil {
+			return nil, err
+		}
+	}
+
+	return spec, nil
+}
+
+func readMappingsFile(path string) (*MappingSpec, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	data = []byte(os.ExpandEnv(string(data)))
+
+	var spec MappingSpec
+
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&spec); err != nil {
+			return nil, fmt.Errorf("error decoding JSON: %v", err)
+		}
+	} else {
+		// YAML is a superset of JSON, so anything that is not explicitly
+		// .json goes through the YAML decoder.
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(&spec); err != nil {
+			return nil, fmt.Errorf("error decoding YAML: %v", err)
+		}
+	}
+
+	return &spec, nil
+}
+
+// inferMappingKind derives the kind from a path and checks it against an
+// explicitly declared kind. The acc:// prefix is stripped from the path.
+func inferMappingKind(path string, declared MappingKind) (string, MappingKind, error) {
+	var kind MappingKind
+
+	switch {
+	case strings.HasPrefix(path, accPrefix):
+		path = strings.TrimPrefix(path, accPrefix)
+		kind = MappingKindAccelerator
+	case declared == MappingKindAccelerator:
+		// Typed mappings may give the accelerator path without the prefix.
+		kind = MappingKindAccelerator
+	case strings.HasPrefix(path, "/mnt/pipe"):
+		kind = MappingKindPipe
+	case strings.HasPrefix(path, "/mnt/graph"):
+		kind = MappingKindGraph
+	case path == string(MappingKindSelectedFiles):
+		kind = MappingKindSelectedFiles
+	case path == string(MappingKindSelectedFolders):
+		kind = MappingKindSelectedFolders
+	default:
+		return path, "", fmt.Errorf("unsupported location %q", path)
+	}
+
+	if declared != "" && declared != kind {
+		return path, "", fmt.Errorf("declared kind %q does not match location %q", declared, path)
+	}
+
+	return path, kind, nil
+}
+
+func normalizeInputMapping(m Mapping) (Mapping, error) {
+	if m.raw == "" {
+		m.raw = m.String()
+	}
+
+	source := strings.TrimSpace(m.Source)
+	destination := strings.TrimSpace(m.Destination)
+
+	source, kind, err := inferMappingKind(source, m.Kind)
+	if err != nil {
+		return m, fmt.Errorf("error: invalid source in input mappings %s: %v", m, err)
+	}
+
+	switch kind {
+	case MappingKindSelectedFiles, MappingKindSelectedFolders:
+		if destination == "" {
+			return m, fmt.Errorf("error: destination for %s mapping should be defined", kind)
+		}
+	case MappingKindAccelerator:
+		prefix, pattern := splitGlobPrefix(source)
+		if pattern != "" {
+			if prefix == "/" {
+				return m, fmt.Errorf("error: invalid source in input mappings %s: the project cannot be a glob", m)
+			}
+			if _, err := compilePathPattern(pattern); err != nil {
+				return m, fmt.Errorf("error: invalid source in input mappings %s: %v", m, err)
+			}
+		}
+
+		// Defaults are derived from the literal part of a glob source.
+		if destination == "" {
+			destination = "/" + prefix
+		}
+		if strings.HasSuffix(destination, "/*") {
+			destination = strings.TrimSuffix(destination, "/*") + "/" + prefix
+		}
+	}
+
+	if len(m.Options.Include) > 0 || len(m.Options.Exclude) > 0 {
+		if kind == MappingKindPipe {
+			return m, fmt.Errorf("error: include/exclude options are not supported for symlinked mappings: %s", m)
+		}
+	}
+
+	if m.Options.Sync {
+		return m, fmt.Errorf("error: sync option is only supported for output mappings: %s", m)
+	}
+
+	if m.Options.Compress != "" {
+		return m, fmt.Errorf("error: compress option is only supported for output mappings: %s", m)
+	}
+
+	if m.Options.Archive != "" {
+		format := ArchiveFormat(m.Options.Archive)
+		if !format.valid() && format != ArchiveAuto {
+			return m, fmt.Errorf("error: unsupported archive format %q in input mapping %s", m.Options.Archive, m)
+		}
+		if kind == MappingKindPipe || kind == MappingKindGraph {
+			return m, fmt.Errorf("error: archive option is only supported for acc:// input mappings: %s", m)
+		}
+		// Archives are extracted into the destination directory.
+		if !strings.HasSuffix(destination, "/") {
+			destination += "/"
+		}
+	}
+
+	m.filter, err = newPathFilter(m.Options.Include, m.Options.Exclude)
+	if err != nil {
+		return m, fmt.Errorf("error: invalid filter in input mapping %s: %v", m, err)
+	}
+
+	if !strings.HasPrefix(destination, "/") {
+		return m, fmt.Errorf("error: invalid destination path %q: always use absolute path", destination)
+	}
+
+	m.Source = source
+	m.Destination = destination
+	m.Kind = kind
+
+	return m, nil
+}
+
+func normalizeOutputMapping(m Mapping) (Mapping, error) {
+	if m.raw == "" {
+		m.raw = m.String()
+	}
+
+	source := strings.TrimSpace(m.Source)
+	destination := strings.TrimSpace(m.Destination)
+
+	if strings.HasPrefix(source, accPrefix) {
+		return m, fmt.Errorf("error: invalid source in output mappings %s", m)
+	}
+
+	if !strings.HasPrefix(source, "/") {
+		return m, fmt.Errorf("error: please use absolute URI for source %s", m.Source)
+	}
+
+	if destination == "" {
+		destination = accPrefix + source
+	}
+
+	destination, kind, err := inferMappingKind(destination, m.Kind)
+	if err != nil || kind == MappingKindSelectedFiles || kind == MappingKindSelectedFolders {
+		return m, fmt.Errorf("error: invalid destination in output mappings %s", m)
+	}
+
+	if len(m.Options.Include) > 0 || len(m.Options.Exclude) > 0 {
+		if kind == MappingKindPipe {
+			return m, fmt.Errorf("error: include/exclude options are not supported for symlinked mappings: %s", m)
+		}
+	}
+
+	if m.Options.Sync && kind != MappingKindAccelerator {
+		return m, fmt.Errorf("error: sync option is only supported for acc:// output mappings: %s", m)
+	}
+
+	if m.Options.Archive != "" {
+		format := ArchiveFormat(m.Options.Archive)
+		if !format.valid() {
+			return m, fmt.Errorf("error: unsupported archive format %q in output mapping %s", m.Options.Archive, m)
+		}
+		if kind != MappingKindAccelerator {
+			return m, fmt.Errorf("error: archive option is only supported for acc:// output mappings: %s", m)
+		}
+		if m.Options.Sync {
+			return m, fmt.Errorf("error: archive and sync options cannot be combined: %s", m)
+		}
+		// The destination names the archive, or the folder it is put in.
+		if strings.HasSuffix(destination, "/") {
+			destination += filepath.Base(source)
+		}
+		if !strings.HasSuffix(destination, format.extension()) {
+			destination += format.extension()
+		}
+	}
+
+	if m.Options.Compress != "" {
+		if !validContentEncoding(m.Options.Compress) {
+			return m, fmt.Errorf("error: unsupported compression %q in output mapping %s", m.Options.Compress, m)
+		}
+		if kind != MappingKindAccelerator {
+			return m, fmt.Errorf("error: compress option is only supported for acc:// output mappings: %s", m)
+		}
+		// Archives carry their own compression, and the stored size and
+		// checksum of a compressed file cannot be compared with the local one.
+		if m.Options.Archive != "" || m.Options.Sync {
+			return m, fmt.Errorf("error: compress option cannot be combined with archive or sync: %s", m)
+		}
+	}
+
+	m.filter, err = newPathFilter(m.Options.Include, m.Options.Exclude)
+	if err != nil {
+		return m, fmt.Errorf("error: invalid filter in output mapping %s: %v", m, err)
+	}
+
+	m.Source = source
+	m.Destination = destination
+	m.Kind = kind
+
+	return m, nil
+}
+
+// skipMissingSource reports whether an optional mapping should be skipped
+// because its source path does not exist.
+func skipMissingSource(m Mapping, path string) bool {
+	if !m.Options.Optional {
+		return false
+	}
+
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		mappingsLog.Warn("Skipping optional mapping: source does not exist", "mapping", m.String())
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,92 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// outputSync tracks the files already present under an output destination so
+// that a sync-mode push only uploads new or changed files.
+type outputSync struct {
+	remote map[string]string
+}
+
+func newOutputSync(destination string) (*outputSync, error) {
+	destKey := strings.Trim(destination, "/")
+
+	files, err := EnumerateFilesByPrefix(destKey)
+	if err != nil {
+		return nil, fmt.Errorf("error listing remote destination %s: %v", destination, err)
+	}
+
+	s := &outputSync{remote: make(map[string]string)}
+
+	for _, file := range files {
+		key := strings.TrimPrefix(file, "/")
+		// The listing is by prefix, so "out" also returns "output/...".
+		if key == destKey || strings.HasPrefix(key, destKey+"/") {
+			s.remote[key] = file
+		}
+	}
+
+	return s, nil
+}
+
+// unchanged reports whether the remote copy of localPath at destPath has the
+// same size and, when one is known, the same checksum.
+func (s *outputSync) unchanged(ctx context.Context, localPath, destPath string) (bool, error) {
+	key := strings.TrimPrefix(destPath, "/")
+
+	remotePath, ok := s.remote[key]
+	if !ok {
+		return false, nil
+	}
+
+	localInfo, err := os.Stat(localPath)
+	if err != nil {
+		return false, err
+	}
+
+	file, err := getFileURLFromRepo(remotePath)
+	if err != nil {
+		return false, fmt.Errorf("error getting download URL for %s: %v", remotePath, err)
+	}
+
+	remoteInfo, err := statRemoteObject(ctx, file)
+	if err != nil {
+		return false, fmt.Errorf("error reading metadata of %s: %v", remotePath, err)
+	}
+
+	if remoteInfo.Size != localInfo.Size() {
+		return false, nil
+	}
+
+	if remoteInfo.SHA256 == "" && remoteInfo.MD5 == "" {
+		return true, nil
+	}
+
+	sums, err := fileChecksums(localPath)
+	if err != nil {
+		return false, err
+	}
+
+	return sums.verify(remoteInfo) == nil, nil
+}
+
+func fileChecksums(path string) (*checksums, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	sums := newChecksums()
+	if _, err := io.Copy(sums, file); err != nil {
+		return nil, fmt.Errorf("error hashing %s: %v", path, err)
+	}
+
+	return sums, nil
+}
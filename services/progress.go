@@ -0,0 +1,281 @@
+package services
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// A transfer logs its progress at most once per progressLogInterval, and
+	// the progress of all transfers is reported to the accelerator once per
+	// progressEventInterval while any of them is running.
+	progressLogInterval   = 15 * time.Second
+	progressEventInterval = 30 * time.Second
+)
+
+const (
+	transferDownload = "download"
+	transferUpload   = "upload"
+)
+
+// transferProgress counts the bytes moved by a single download or upload and
+// logs bytes transferred, rate and ETA to the job log, throttled to
+// progressLogInterval.
+type transferProgress struct {
+	direction string
+	name      string
+	total     int64 // negative when unknown
+	started   time.Time
+
+	transferred atomic.Int64
+	nextLog     atomic.Int64 // unix nanoseconds
+	logged      atomic.Bool
+}
+
+// startProgress registers a transfer of total bytes, or of unknown size when
+// total is negative. finish must be called once it is over.
+func startProgress(direction, name string, total int64) *transferProgress {
+	p := &transferProgress{
+		direction: direction,
+		name:      name,
+		total:     total,
+		started:   time.Now(),
+	}
+	p.nextLog.Store(p.started.Add(progressLogInterval).UnixNano())
+
+	transferProgressReporter.register(p)
+
+	return p
+}
+
+// add records n more bytes transferred. A negative n takes back bytes that
+// have to be sent again after a failed attempt.
+func (p *transferProgress) add(n int64) {
+	transferred := p.transferred.Add(n)
+
+	now := time.Now()
+	next := p.nextLog.Load()
+	if now.UnixNano() < next || !p.nextLog.CompareAndSwap(next, now.Add(progressLogInterval).UnixNano()) {
+		return
+	}
+
+	p.logged.Store(true)
+	mappingsLog.Info(fmt.Sprintf("%s %s: %s", p.verb(), p.name, p.status(transferred, now)))
+}
+
+// finish unregisters the transfer. Transfers that logged their progress also
+// log a summary.
+func (p *transferProgress) finish() {
+	transferProgressReporter.unregister(p)
+
+	if p.logged.Load() {
+		elapsed := time.Since(p.started)
+		transferred := p.transferred.Load()
+		mappingsLog.Info(fmt.Sprintf("%s %s: %s in %s (%s/s)", p.verb(), p.name,
+			formatBytes(transferred), elapsed.Round(time.Second), formatBytes(bytesPerSecond(transferred, elapsed))))
+	}
+}
+
+func (p *transferProgress) verb() string {
+	if p.direction == transferDownload {
+		return "Downloading"
+	}
+	return "Uploading"
+}
+
+func (p *transferProgress) status(transferred int64, now time.Time) string {
+	rate := bytesPerSecond(transferred, now.Sub(p.started))
+
+	if p.total < 0 {
+		return fmt.Sprintf("%s, %s/s", formatBytes(transferred), formatBytes(rate))
+	}
+
+	status := fmt.Sprintf("%s of %s (%d%%), %s/s", formatBytes(transferred), formatBytes(p.total),
+		percentOf(transferred, p.total), formatBytes(rate))
+	if rate > 0 && transferred < p.total {
+		eta := time.Duration(float64(p.total-transferred) / float64(rate) * float64(time.Second))
+		status += fmt.Sprintf(", ETA %s", eta.Round(time.Second))
+	}
+
+	return status
+}
+
+// reader returns a reader that counts everything read from r as transferred.
+func (p *transferProgress) reader(r io.Reader) *progressReader {
+	return &progressReader{r: r, progress: p}
+}
+
+// progressReader counts the bytes read through it, so that they can be taken
+// back with rollback when the attempt they were read for fails.
+type progressReader struct {
+	r        io.Reader
+	progress *transferProgress
+	n        int64
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.n += int64(n)
+		r.progress.add(int64(n))
+	}
+	return n, err
+}
+
+func (r *progressReader) rollback() {
+	r.progress.add(-r.n)
+	r.n = 0
+}
+
+// progressReporter aggregates the running transfers and sends their progress
+// as TRANSFER_PROGRESS webhook events. It runs while transfers are active and
+// sends a last event once the final one has finished.
+type progressReporter struct {
+	mu      sync.Mutex
+	running bool
+	active  map[*transferProgress]struct{}
+
+	// Bytes of the transfers that finished since the reporter started.
+	finished map[string]*transferTotals
+}
+
+type transferTotals struct {
+	Active           int   `json:"active"`
+	Completed        int   `json:"completed"`
+	TransferredBytes int64 `json:"transferred_bytes"`
+	TotalBytes       int64 `json:"total_bytes"`
+	BytesPerSecond   int64 `json:"bytes_per_second"`
+}
+
+type transferProgressEventData struct {
+	Downloads transferTotals `json:"downloads"`
+	Uploads   transferTotals `json:"uploads"`
+}
+
+var transferProgressReporter = &progressReporter{
+	active:   make(map[*transferProgress]struct{}),
+	finished: make(map[string]*transferTotals),
+}
+
+func (r *progressReporter) register(p *transferProgress) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.active[p] = struct{}{}
+
+	if !r.running {
+		r.running = true
+		go r.run()
+	}
+}
+
+func (r *progressReporter) unregister(p *transferProgress) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.active, p)
+
+	totals := r.finishedTotals(p.direction)
+	totals.Completed++
+	totals.TransferredBytes += p.transferred.Load()
+	totals.TotalBytes += max(p.total, 0)
+}
+
+func (r *progressReporter) finishedTotals(direction string) *transferTotals {
+	totals, ok := r.finished[direction]
+	if !ok {
+		totals = &transferTotals{}
+		r.finished[direction] = totals
+	}
+	return totals
+}
+
+func (r *progressReporter) run() {
+	tick := time.NewTicker(progressEventInterval)
+	defer tick.Stop()
+
+	previous := transferProgressEventData{}
+
+	for range tick.C {
+		event, idle := r.snapshot()
+
+		// The rate is over the last interval, across all transfers.
+		event.Downloads.BytesPerSecond = bytesPerSecond(event.Downloads.TransferredBytes-previous.Downloads.TransferredBytes, progressEventInterval)
+		event.Uploads.BytesPerSecond = bytesPerSecond(event.Uploads.TransferredBytes-previous.Uploads.TransferredBytes, progressEventInterval)
+		previous = event
+
+		if err := SendWebhookEvent("TRANSFER_PROGRESS", event); err != nil {
+			mappingsLog.Warn("Error reporting transfer progress", "err", err)
+		}
+
+		if idle {
+			return
+		}
+	}
+}
+
+// snapshot sums up the active and finished transfers. When none is active the
+// reporter is stopped and its totals are reset, so the next batch of
+// transfers is reported on its own.
+func (r *progressReporter) snapshot() (transferProgressEventData, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var event transferProgressEventData
+	byDirection := map[string]*transferTotals{
+		transferDownload: &event.Downloads,
+		transferUpload:   &event.Uploads,
+	}
+
+	for direction, finished := range r.finished {
+		*byDirection[direction] = *finished
+	}
+
+	for p := range r.active {
+		totals := byDirection[p.direction]
+		totals.Active++
+		totals.TransferredBytes += p.transferred.Load()
+		totals.TotalBytes += max(p.total, 0)
+	}
+
+	idle := len(r.active) == 0
+	if idle {
+		r.running = false
+		r.finished = make(map[string]*transferTotals)
+	}
+
+	return event, idle
+}
+
+func bytesPerSecond(n int64, elapsed time.Duration) int64 {
+	if elapsed <= 0 || n <= 0 {
+		return 0
+	}
+	return int64(float64(n) / elapsed.Seconds())
+}
+
+func percentOf(n, total int64) int64 {
+	if total <= 0 {
+		return 100
+	}
+	return n * 100 / total
+}
+
+// formatBytes renders a byte count with a binary unit, e.g. "1.5 GiB".
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
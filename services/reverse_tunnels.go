@@ -68,24 +68,24 @@ func startReverseTunnel(localSocket string) error {
 	if strings.HasPrefix(localSocket, "unix:") {
 		unixPath := strings.TrimPrefix(localSocket, "unix:")
 		sshArgs = append(sshArgs, "-R", remoteSocketPath+":"+unixPath)
-		fmt.Fprintf(MultiLogWriter, "Setting up UNIX → UNIX tunnel: %s -> %s \n", unixPath, remoteSocketPath)
+		tunnelLog.Info("Setting up UNIX → UNIX tunnel", "local", unixPath, "remote", remoteSocketPath)
 	} else {
 		sshArgs = append(sshArgs, "-R", remoteSocketPath+":"+localSocket)
-		fmt.Fprintf(MultiLogWriter, "Setting up TCP → UNIX tunnel: %s -> %s \n", localSocket, remoteSocketPath)
+		tunnelLog.Info("Setting up TCP → UNIX tunnel", "local", localSocket, "remote", remoteSocketPath)
 	}
 
 	sshArgs = append(sshArgs, sshUser+"@"+sshServer)
 
 	cmd := exec.Command("/mnt/agent/ssh", sshArgs...)
-	cmd.Stdout = MultiLogWriter
-	cmd.Stderr = MultiLogWriter
+	cmd.Stdout = tunnelOutput
+	cmd.Stderr = tunnelOutput
 
-	// fmt.Fprintf(MultiLogWriter, "Starting reverse tunnel with command: ssh %s \n", strings.Join(sshArgs, " "))
-	fmt.Fprintf(MultiLogWriter, "Starting tunnel at 🔗  %s.%s%s \n", randomUUID.String(), tunnelGatewayDomain, tunnelGatewayPort)
+	// tunnelLog.Debug("Starting reverse tunnel", "command", "ssh "+strings.Join(sshArgs, " "))
+	tunnelLog.Info("Starting tunnel at 🔗  " + randomUUID.String() + "." + tunnelGatewayDomain + tunnelGatewayPort)
 	if err := cmd.Run(); err != nil {
 		return fmt.Errorf("failed to start SSH reverse tunnel: %v", err)
 	} else {
-		fmt.Fprintf(MultiLogWriter, "Interactive socket tunneled at: %s.%s \n", randomUUID.String(), tunnelGatewayDomain)
+		tunnelLog.Info("Interactive socket tunneled at: " + randomUUID.String() + "." + tunnelGatewayDomain)
 	}
 
 	return nil
@@ -105,12 +105,12 @@ func StartTunnelWithRestart(ctx context.Context, localSocket string, errCh chan<
 		for {
 			select {
 			case <-ctx.Done():
-				fmt.Fprintln(MultiLogWriter, "Tunnel goroutine exiting due to context cancellation")
+				tunnelLog.Debug("Tunnel goroutine exiting due to context cancellation")
 				return
 			default:
 				err := startReverseTunnel(localSocket)
 				if err != nil {
-					fmt.Fprintf(MultiLogWriter, "Tunnel process exited with error: %v\n", err)
+					tunnelLog.Error("Tunnel process exited with error", "err", err)
 					consecutiveFails++
 
 					if consecutiveFails == 1 {
@@ -123,7 +123,7 @@ func StartTunnelWithRestart(ctx context.Context, localSocket string, errCh chan<
 						return
 					}
 
-					fmt.Fprintf(MultiLogWriter, "Retrying tunnel in %s (%d/%d)\n", retryDelay, consecutiveFails, maxConsecutiveErr)
+					tunnelLog.Info("Retrying tunnel", "delay", retryDelay, "attempt", consecutiveFails, "max_attempts", maxConsecutiveErr)
 					time.Sleep(retryDelay)
 					continue
 				}
@@ -0,0 +1,149 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"golang.org/x/sync/semaphore"
+)
+
+const (
+	defaultDownloadConcurrency = 4
+	defaultUploadConcurrency   = 4
+
+	defaultUploadMaxRequests      = 8
+	defaultUploadMaxInflightBytes = 256 * 1024 * 1024
+)
+
+// transferPool runs mapping tasks with bounded concurrency. The first failing
+// task cancels the pool's context so queued tasks are skipped and running
+// transfers are interrupted. Wait reports every error that occurred.
+type transferPool struct {
+	parent context.Context
+	ctx    context.Context
+	cancel context.CancelFunc
+	slots  chan struct{}
+	wg     sync.WaitGroup
+	mu     sync.Mutex
+	errs   []error
+}
+
+func newTransferPool(ctx context.Context, concurrency int) *transferPool {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	poolCtx, cancel := context.WithCancel(ctx)
+
+	return &transferPool{
+		parent: ctx,
+		ctx:    poolCtx,
+		cancel: cancel,
+		slots:  make(chan struct{}, concurrency),
+	}
+}
+
+// Go blocks until a slot is free and runs task in it. Tasks submitted after
+// the pool has been cancelled are dropped.
+func (p *transferPool) Go(task func(ctx context.Context) error) {
+	select {
+	case p.slots <- struct{}{}:
+	case <-p.ctx.Done():
+		return
+	}
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		defer func() { <-p.slots }()
+
+		if p.ctx.Err() != nil {
+			return
+		}
+
+		if err := task(p.ctx); err != nil {
+			p.fail(err)
+		}
+	}()
+}
+
+func (p *transferPool) fail(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// Tasks interrupted by an earlier failure only add noise.
+	if p.ctx.Err() != nil && errors.Is(err, context.Canceled) {
+		return
+	}
+
+	p.errs = append(p.errs, err)
+	p.cancel()
+}
+
+// Wait blocks until all submitted tasks have finished.
+func (p *transferPool) Wait() error {
+	p.wg.Wait()
+	p.cancel()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.errs) == 0 {
+		return p.parent.Err()
+	}
+
+	return errors.Join(p.errs...)
+}
+
+// transferBudget bounds the upload parts in flight across all concurrent file
+// uploads, both by number of requests and by bytes. Stream parts are buffered
+// in memory while they wait to be sent, so the byte limit also bounds the
+// memory uploads can take.
+type transferBudget struct {
+	requests *semaphore.Weighted
+	bytes    *semaphore.Weighted
+	maxBytes int64
+}
+
+var (
+	uploadBudgetOnce sync.Once
+	uploadBudget     *transferBudget
+)
+
+// sharedUploadBudget returns the budget of all uploads, configured by
+// upload_max_requests and upload_max_inflight_bytes.
+func sharedUploadBudget() *transferBudget {
+	uploadBudgetOnce.Do(func() {
+		maxRequests := max(getenvInt("upload_max_requests", defaultUploadMaxRequests), 1)
+		maxBytes := max(int64(getenvInt("upload_max_inflight_bytes", defaultUploadMaxInflightBytes)), 1)
+
+		uploadBudget = &transferBudget{
+			requests: semaphore.NewWeighted(int64(maxRequests)),
+			bytes:    semaphore.NewWeighted(maxBytes),
+			maxBytes: maxBytes,
+		}
+	})
+
+	return uploadBudget
+}
+
+// acquire blocks until a request of size bytes fits the budget and returns
+// the function that gives it back. A request larger than the whole byte
+// budget only has to wait for everything else to finish.
+func (b *transferBudget) acquire(ctx context.Context, size int64) (func(), error) {
+	if err := b.requests.Acquire(ctx, 1); err != nil {
+		return nil, err
+	}
+
+	weight := min(size, b.maxBytes)
+	if err := b.bytes.Acquire(ctx, weight); err != nil {
+		b.requests.Release(1)
+		return nil, err
+	}
+
+	return func() {
+		b.bytes.Release(weight)
+		b.requests.Release(1)
+	}, nil
+}
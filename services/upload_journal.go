@@ -0,0 +1,159 @@
+package services
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const defaultUploadJournalPath = "/mnt/agent/uploads.journal"
+
+// uploadJournal records the multipart uploads this pod has started and not yet
+// completed or aborted. The agent volume outlives container restarts, so an
+// upload interrupted by an OOM kill or eviction can still be aborted by the
+// next run instead of lingering in the bucket.
+//
+// The journal is a JSON line per event: "start" when an upload ID is created
+// and "end" once the upload is completed or aborted.
+type uploadJournal struct {
+	mu   sync.Mutex
+	path string
+}
+
+type uploadJournalEntry struct {
+	Op          string `json:"op"`
+	UploadID    string `json:"upload_id"`
+	AppBucketID int    `json:"app_bucket_id,omitempty"`
+	Filename    string `json:"filename,omitempty"`
+}
+
+// pendingUploads is nil when no journal could be opened; its methods are then
+// no-ops.
+var pendingUploads *uploadJournal
+
+// newUploadJournal uses UPLOAD_JOURNAL_PATH, or the agent volume by default.
+func newUploadJournal() (*uploadJournal, error) {
+	path := getenvWithDefault("UPLOAD_JOURNAL_PATH", defaultUploadJournalPath)
+
+	if err := os.MkdirAll(filepath.Dir(path), 0775); err != nil {
+		return nil, fmt.Errorf("error creating upload journal directory: %v", err)
+	}
+
+	return &uploadJournal{path: path}, nil
+}
+
+func (j *uploadJournal) append(entry uploadJournalEntry) {
+	if j == nil {
+		return
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	f, err := os.OpenFile(j.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		mappingsLog.Warn("Error writing upload journal", "err", err)
+		return
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		mappingsLog.Warn("Error writing upload journal", "err", err)
+	}
+}
+
+func (j *uploadJournal) started(upload *MultipartUploadIDCreateResponse) {
+	j.append(uploadJournalEntry{
+		Op:          "start",
+		UploadID:    upload.UploadID,
+		AppBucketID: upload.AppBucketID,
+		Filename:    upload.UniquifiedFilename,
+	})
+}
+
+func (j *uploadJournal) ended(upload *MultipartUploadIDCreateResponse) {
+	j.append(uploadJournalEntry{Op: "end", UploadID: upload.UploadID})
+}
+
+// open returns the uploads that were started but never ended, in start order.
+func (j *uploadJournal) open() ([]uploadJournalEntry, error) {
+	f, err := os.Open(j.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var started []uploadJournalEntry
+	ended := make(map[string]bool)
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry uploadJournalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// A line torn by a crash mid-write.
+			continue
+		}
+		switch entry.Op {
+		case "start":
+			started = append(started, entry)
+		case "end":
+			ended[entry.UploadID] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	var open []uploadJournalEntry
+	for _, entry := range started {
+		if !ended[entry.UploadID] {
+			open = append(open, entry)
+		}
+	}
+
+	return open, nil
+}
+
+// sweep aborts the uploads a previous run left open and rewrites the journal
+// with those that could not be aborted, to be retried by the next run. It
+// must run before any upload is started.
+func (j *uploadJournal) sweep() {
+	if j == nil {
+		return
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	open, err := j.open()
+	if err != nil {
+		mappingsLog.Warn("Error reading upload journal", "err", err)
+		return
+	}
+
+	var remaining []byte
+	for _, entry := range open {
+		mappingsLog.Info("Aborting incomplete upload left by a previous run", "file", entry.Filename)
+
+		if _, err := abortCreateMultipartUpload(entry.AppBucketID, entry.Filename, entry.UploadID); err != nil {
+			mappingsLog.Warn("Error aborting upload", "file", entry.Filename, "err", err)
+			line, _ := json.Marshal(entry)
+			remaining = append(remaining, append(line, '\n')...)
+		}
+	}
+
+	if err := os.WriteFile(j.path, remaining, 0644); err != nil {
+		mappingsLog.Warn("Error rewriting upload journal", "err", err)
+	}
+}
@@ -0,0 +1,505 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	mib = 1024 * 1024
+
+	// S3 limits: at most 10,000 parts of at most 5 GiB each.
+	maxUploadParts = 10000
+	maxPartSize    = 5 * 1024 * mib
+
+	// Parts of on-disk files are streamed from the file, so they can be large
+	// without costing memory. Non-seekable streams are buffered part by part.
+	defaultFilePartSize = 64 * mib
+	streamPartSize      = 16 * mib
+
+	maxPartAttempts   = 5
+	partRetryDelay    = 1 * time.Second
+	maxPartRetryDelay = 30 * time.Second
+)
+
+// partBufferPool holds the part buffers of non-seekable uploads.
+var partBufferPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, streamPartSize)
+		return &buf
+	},
+}
+
+// partSizeFor returns the part size for a file of the given size: the
+// default, or more when the file would otherwise need more than
+// maxUploadParts parts.
+func partSizeFor(size int64) int64 {
+	partSize := int64(defaultFilePartSize)
+	if minimum := (size + maxUploadParts - 1) / maxUploadParts; minimum > partSize {
+		partSize = (minimum + mib - 1) / mib * mib
+	}
+	return partSize
+}
+
+// uploadPart is one part of a multipart upload. body can be re-read from the
+// start, release returns its buffer, if any, to the pool.
+type uploadPart struct {
+	number  int
+	body    *io.SectionReader
+	md5     string
+	release func()
+}
+
+// partReader cuts an upload into parts. Regular files are served as sections
+// of the file; anything else is read into pooled buffers. Parts are produced
+// in order, which lets the whole upload be hashed along the way.
+type partReader struct {
+	file     *os.File
+	base     int64
+	size     int64
+	stream   io.Reader
+	partSize int64
+
+	sums   *checksums
+	number int
+	offset int64
+	done   bool
+}
+
+func newPartReader(r io.Reader, sums *checksums) (*partReader, error) {
+	p := &partReader{stream: r, partSize: streamPartSize, sums: sums}
+
+	if file, ok := r.(*os.File); ok {
+		info, statErr := file.Stat()
+		base, seekErr := file.Seek(0, io.SeekCurrent)
+		if statErr == nil && seekErr == nil && info.Mode().IsRegular() {
+			p.file = file
+			p.base = base
+			p.size = info.Size() - base
+			p.partSize = partSizeFor(p.size)
+			if p.partSize > maxPartSize {
+				return nil, fmt.Errorf("file of %d bytes exceeds the maximum upload size", p.size)
+			}
+		}
+	}
+
+	return p, nil
+}
+
+// Next returns the next part, or nil after the last one. An empty upload
+// still yields a single empty part.
+func (p *partReader) Next() (*uploadPart, error) {
+	if p.done {
+		return nil, nil
+	}
+
+	if p.number == maxUploadParts {
+		return nil, fmt.Errorf("upload exceeds %d parts of %d bytes", maxUploadParts, p.partSize)
+	}
+
+	partHash := md5.New()
+
+	if p.file != nil {
+		length := min(p.partSize, p.size-p.offset)
+		start := p.base + p.offset
+
+		if _, err := io.Copy(io.MultiWriter(partHash, p.sums), io.NewSectionReader(p.file, start, length)); err != nil {
+			return nil, fmt.Errorf("error reading part data: %v", err)
+		}
+
+		p.offset += length
+		p.done = p.offset >= p.size
+		p.number++
+
+		return &uploadPart{
+			number:  p.number,
+			body:    io.NewSectionReader(p.file, start, length),
+			md5:     base64.StdEncoding.EncodeToString(partHash.Sum(nil)),
+			release: func() {},
+		}, nil
+	}
+
+	bufp := partBufferPool.Get().(*[]byte)
+	release := func() { partBufferPool.Put(bufp) }
+
+	n, err := io.ReadFull(p.stream, *bufp)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		p.done = true
+	} else if err != nil {
+		release()
+		return nil, fmt.Errorf("error reading part data: %v", err)
+	}
+
+	if n == 0 && p.number > 0 {
+		release()
+		return nil, nil
+	}
+
+	data := (*bufp)[:n]
+	partHash.Write(data)
+	p.sums.Write(data)
+	p.offset += int64(n)
+	p.number++
+
+	return &uploadPart{
+		number:  p.number,
+		body:    io.NewSectionReader(bytes.NewReader(data), 0, int64(n)),
+		md5:     base64.StdEncoding.EncodeToString(partHash.Sum(nil)),
+		release: release,
+	}, nil
+}
+
+// errPartURLExpired is returned by putPart when the object store rejects the
+// presigned URL, typically because it expired while the part was queued or
+// being retried.
+var errPartURLExpired = errors.New("presigned part URL rejected")
+
+// uploadPartWithRetry uploads a part, retrying failed attempts with
+// exponential backoff and jitter. A rejected presigned URL is replaced with a
+// fresh one before the next attempt.
+func uploadPartWithRetry(ctx context.Context, upload *MultipartUploadIDCreateResponse, part *uploadPart, putPresignedURL string, progress *transferProgress, limit *bandwidthLimit) (string, error) {
+	for attempt := 1; ; attempt++ {
+		etag, err := putPart(ctx, putPresignedURL, part, progress, limit)
+		if err == nil {
+			return etag, nil
+		}
+
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+
+		var permanent *permanentPartError
+		if errors.As(err, &permanent) {
+			return "", fmt.Errorf("error uploading part %d: %v", part.number, err)
+		}
+
+		if attempt >= maxPartAttempts {
+			return "", fmt.Errorf("error uploading part %d: giving up after %d attempts: %v", part.number, attempt, err)
+		}
+
+		mappingsLog.Warn("Upload of part failed, retrying", "part", part.number, "err", err)
+
+		select {
+		case <-time.After(retryDelay(attempt)):
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+
+		if errors.Is(err, errPartURLExpired) {
+			signedURL, err := getMultipartPutCreateSignedURL(upload.AppBucketID,
+				upload.UniquifiedFilename, upload.UploadID, part.number)
+			if err != nil {
+				mappingsLog.Warn("Error refreshing signed URL of part", "part", part.number, "err", err)
+				continue
+			}
+			putPresignedURL = *signedURL
+		}
+	}
+}
+
+// retryDelay is the exponential backoff before retry attempt+1, randomized
+// over its upper half so parallel parts do not retry in lockstep.
+func retryDelay(attempt int) time.Duration {
+	delay := min(partRetryDelay*(1<<(attempt-1)), maxPartRetryDelay)
+	return delay/2 + rand.N(delay/2)
+}
+
+// permanentPartError is a part upload failure that retrying cannot fix.
+type permanentPartError struct {
+	err error
+}
+
+func (e *permanentPartError) Error() string { return e.err.Error() }
+
+// putPart makes a single attempt at uploading a part and returns its ETag.
+// The bytes sent are throttled to limit and counted on progress, and taken
+// back if the attempt fails.
+func putPart(ctx context.Context, putPresignedURL string, part *uploadPart, progress *transferProgress, limit *bandwidthLimit) (etag string, err error) {
+	if _, err := part.body.Seek(0, io.SeekStart); err != nil {
+		return "", &permanentPartError{fmt.Errorf("error rewinding part data: %v", err)}
+	}
+
+	sent := progress.reader(part.body)
+	defer func() {
+		if err != nil {
+			sent.rollback()
+		}
+	}()
+
+	body := limit.reader(ctx, sent)
+	if part.body.Size() == 0 {
+		// A zero ContentLength with a body would be sent chunked.
+		body = http.NoBody
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "PUT", putPresignedURL, body)
+	if err != nil {
+		return "", &permanentPartError{fmt.Errorf("error creating part upload request: %v", err)}
+	}
+	req.ContentLength = part.body.Size()
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	// Lets the object store reject a part corrupted in transit.
+	req.Header.Set("Content-MD5", part.md5)
+
+	// Retries are handled by uploadPartWithRetry, and a part may take longer
+	// than the regular client timeout.
+	resp, err := HTTPTransferClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("error uploading part: %v", err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+	case resp.StatusCode == http.StatusForbidden:
+		return "", fmt.Errorf("%w: %v", errPartURLExpired, HandleHTTPError(resp))
+	case resp.StatusCode == http.StatusRequestTimeout, resp.StatusCode == http.StatusTooManyRequests,
+		resp.StatusCode >= 500:
+		return "", fmt.Errorf("part upload failed with status: %v", HandleHTTPError(resp))
+	default:
+		return "", &permanentPartError{fmt.Errorf("part upload failed with status: %v", HandleHTTPError(resp))}
+	}
+
+	etag = resp.Header.Get("ETag")
+	if etag == "" {
+		return "", errors.New("ETag not found in part upload response")
+	}
+
+	return strings.Trim(etag, `"`), nil
+}
+
+// uploadResult describes a completed job output upload.
+type uploadResult struct {
+	BucketObjectID int
+	ObjectName     string
+	Size           int64
+	Checksums      uploadChecksums
+
+	// ContentEncoding is the compression the object is stored with. Size and
+	// checksums are of the stored, compressed bytes.
+	ContentEncoding string
+}
+
+// addFilestreamAsJobOutput uploads fileStream as a job output through a
+// multipart upload. On any failure, including cancellation of ctx, the
+// multipart upload is aborted so no orphaned parts stay behind in the bucket.
+// A non-empty contentEncoding compresses the stream on the fly and records
+// the encoding on the object.
+func addFilestreamAsJobOutput(ctx context.Context, filename string, fileStream io.Reader, isLogFile bool, contentEncoding string) (*uploadResult, error) {
+	var uploadIDDetailsResponse *MultipartUploadIDCreateResponse
+
+	var parts [][]string
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	budget := sharedUploadBudget() // Shared by all concurrent uploads
+	errChan := make(chan error, 1) // Capture the first error
+
+	// Create a cancellable context
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel() // Ensure cancellation on function exit
+
+	fail := func(err error) {
+		select {
+		case errChan <- err:
+		default:
+		}
+		cancel()
+	}
+
+	if contentEncoding != "" {
+		compressed := compressingReader(fileStream, contentEncoding)
+		defer compressed.Close()
+		fileStream = compressed
+	}
+
+	sums := newChecksums()
+
+	partSource, err := newPartReader(fileStream, sums)
+	if err != nil {
+		return nil, err
+	}
+
+	size := int64(-1)
+	if partSource.file != nil {
+		size = partSource.size
+	}
+	progress := startProgress(transferUpload, filename, size)
+	defer progress.finish()
+
+	limit := newBandwidthLimit(transferUpload)
+
+	for ctx.Err() == nil {
+		// The budget is taken before the part is read, so buffered stream
+		// parts count against it too.
+		release, err := budget.acquire(ctx, partSource.partSize)
+		if err != nil {
+			break
+		}
+
+		part, err := partSource.Next()
+		if err != nil || part == nil {
+			release()
+			if err != nil {
+				fail(err)
+			}
+			break
+		}
+
+		if uploadIDDetailsResponse == nil {
+			uploadIDDetailsResponse, err = getPutCreateMultipartUploadID(filename, contentEncoding)
+			if err != nil {
+				release()
+				part.release()
+				fail(fmt.Errorf("error getting upload ID: %v", err))
+				break
+			}
+			pendingUploads.started(uploadIDDetailsResponse)
+		}
+
+		signedURLResult, err := getMultipartPutCreateSignedURL(uploadIDDetailsResponse.AppBucketID,
+			uploadIDDetailsResponse.UniquifiedFilename,
+			uploadIDDetailsResponse.UploadID,
+			part.number)
+		if err != nil {
+			release()
+			part.release()
+			fail(fmt.Errorf("error getting signed URL: %v", err))
+			break
+		}
+
+		wg.Add(1)
+		go func(part *uploadPart, putPresignedURL string) {
+			defer wg.Done()
+			defer release()
+			defer part.release()
+
+			etag, err := uploadPartWithRetry(ctx, uploadIDDetailsResponse, part, putPresignedURL, progress, limit)
+			if err != nil {
+				fail(err)
+				return
+			}
+
+			mutex.Lock()
+			parts = append(parts, []string{fmt.Sprintf("%d", part.number), etag})
+			mutex.Unlock()
+
+		}(part, *signedURLResult)
+	}
+
+	wg.Wait()
+
+	select {
+	case err = <-errChan:
+		err = fmt.Errorf("error uploading part of multipart upload: %w", err)
+	default:
+		if ctx.Err() != nil {
+			err = fmt.Errorf("upload cancelled: %w", ctx.Err())
+		}
+	}
+
+	if err != nil {
+		return nil, abortJobMultipartUpload(uploadIDDetailsResponse, err)
+	}
+
+	// Sort the parts array by partNumber (converted to integer) before calling completeJobMultipartUpload
+	sort.Slice(parts, func(i, j int) bool {
+		partNumberI, _ := strconv.Atoi(parts[i][0])
+		partNumberJ, _ := strconv.Atoi(parts[j][0])
+		return partNumberI < partNumberJ
+	})
+
+	checksums := uploadChecksums{SHA256: sums.SHA256(), MD5: sums.MD5()}
+
+	// Complete the upload only if everything is successful
+	result, err := completeJobMultipartUpload(uploadIDDetailsResponse.AppBucketID,
+		uploadIDDetailsResponse.UniquifiedFilename,
+		uploadIDDetailsResponse.UploadID, parts, isLogFile, &checksums, contentEncoding)
+	if err == nil && result == nil {
+		err = errors.New("no bucket object ID returned")
+	}
+	if err != nil {
+		return nil, abortJobMultipartUpload(uploadIDDetailsResponse,
+			fmt.Errorf("error completing multipart upload: %v", err))
+	}
+
+	pendingUploads.ended(uploadIDDetailsResponse)
+
+	return &uploadResult{
+		BucketObjectID: *result,
+		ObjectName:     uploadIDDetailsResponse.UniquifiedFilename,
+		Size:           partSource.offset,
+		Checksums:      checksums,
+
+		ContentEncoding: contentEncoding,
+	}, nil
+}
+
+// abortJobMultipartUpload aborts a failed upload, if it got as far as creating
+// one, and returns cause, together with the abort error if that failed too.
+// Uploads that could not be aborted stay in the journal for the next sweep.
+func abortJobMultipartUpload(upload *MultipartUploadIDCreateResponse, cause error) error {
+	if upload == nil {
+		return cause
+	}
+
+	if _, err := abortCreateMultipartUpload(upload.AppBucketID, upload.UniquifiedFilename, upload.UploadID); err != nil {
+		return fmt.Errorf("%w (error aborting upload: %v)", cause, err)
+	}
+
+	pendingUploads.ended(upload)
+
+	return cause
+}
+
+func UploadFile(ctx context.Context, localPath string, remotePath string) error {
+	_, err := uploadFile(ctx, localPath, remotePath, "")
+	return err
+}
+
+// UploadLogFile is UploadFile for the full job log, which is compressed with
+// the log_compression encoding when one is set.
+func UploadLogFile(ctx context.Context, localPath string, remotePath string) error {
+	_, err := uploadFile(ctx, localPath, remotePath, LogCompression)
+	return err
+}
+
+// uploadFile is UploadFile returning the details of the created object. A
+// non-empty contentEncoding uploads the file compressed.
+func uploadFile(ctx context.Context, localPath string, remotePath string, contentEncoding string) (*uploadResult, error) {
+
+	log := mappingsLog.With("path", localPath, "remote", remotePath)
+	if contentEncoding != "" {
+		log = log.With("encoding", contentEncoding)
+	}
+	log.Info("Uploading file to remote job output folder")
+
+	// Open the files
+	file, err := os.Open(localPath)
+	if err != nil {
+		return nil, fmt.Errorf("error opening file: %v", err)
+	}
+	defer file.Close()
+
+	// Upload the file with the given remote path
+	result, err := addFilestreamAsJobOutput(ctx, remotePath, file, false, contentEncoding)
+	if err != nil {
+		return nil, fmt.Errorf("error uploading file: %v", err)
+	}
+
+	log.Info("Upload successful", "bucket_object_id", result.BucketObjectID, "sha256", result.Checksums.SHA256)
+	return result, nil
+}
@@ -0,0 +1,87 @@
+package services
+
+import (
+	"fmt"
+	"io"
+)
+
+// ValidateMappings runs the mapping parser used by PreProcessMappings and
+// PostProcessMappings, resolves selections and remote listings, and writes
+// the planned operations to w without touching the filesystem.
+func ValidateMappings(w io.Writer) error {
+	spec, err := LoadMappingSpec()
+	if err != nil {
+		return fmt.Errorf("error: error loading mappings %v", err)
+	}
+
+	fmt.Fprintln(w, "Input mappings:")
+
+	if err := planInputMappings(w, spec.Inputs); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(w, "Output mappings:")
+
+	for _, mapping := range spec.Outputs {
+		switch mapping.Kind {
+		case MappingKindPipe:
+			fmt.Fprintf(w, "  symlink   %s -> %s (before the job starts)\n", mapping.Destination, mapping.Source)
+		case MappingKindGraph:
+			fmt.Fprintf(w, "  copy      %s -> %s\n", mapping.Source, mapping.Destination)
+		case MappingKindAccelerator:
+			action := "upload"
+			if mapping.Options.Sync {
+				action = "sync"
+			}
+			if mapping.Options.Archive != "" {
+				action = "archive"
+			}
+			var note string
+			if mapping.Options.Compress != "" {
+				note = fmt.Sprintf(" (%s)", mapping.Options.Compress)
+			}
+			fmt.Fprintf(w, "  %-9s %s -> %s%s%s\n", action, mapping.Source, accPrefix, mapping.Destination, note)
+		}
+	}
+
+	return nil
+}
+
+func planInputMappings(w io.Writer, inputMappings []Mapping) error {
+	for _, mapping := range inputMappings {
+		switch mapping.Kind {
+		case MappingKindSelectedFiles, MappingKindSelectedFolders:
+			newMappings, err := expandSelectedInputs(mapping)
+			if err != nil {
+				return err
+			}
+
+			if err := planInputMappings(w, newMappings); err != nil {
+				return err
+			}
+		case MappingKindPipe:
+			fmt.Fprintf(w, "  symlink   %s -> %s\n", mapping.Source, mapping.Destination)
+		case MappingKindGraph:
+			fmt.Fprintf(w, "  copy      %s -> %s\n", mapping.Source, mapping.Destination)
+		case MappingKindAccelerator:
+			transfers, err := planRemoteCopy(mapping)
+			if err != nil {
+				return fmt.Errorf("error planning mapping %s: %v", mapping, err)
+			}
+
+			if len(transfers) == 0 {
+				fmt.Fprintf(w, "  download  %s%s: no files found\n", accPrefix, mapping.Source)
+			}
+
+			for _, transfer := range transfers {
+				if mapping.Options.Archive != "" {
+					fmt.Fprintf(w, "  extract   %s%s -> %s\n", accPrefix, transfer.Source, mapping.Destination)
+					continue
+				}
+				fmt.Fprintf(w, "  download  %s%s -> %s\n", accPrefix, transfer.Source, transfer.Destination)
+			}
+		}
+	}
+
+	return nil
+}